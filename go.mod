@@ -1,3 +1,14 @@
 module 9pserver
 
 go 1.19
+
+require (
+	github.com/pkg/sftp v1.13.6
+	golang.org/x/sys v0.1.0
+	golang.org/x/text v0.4.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/crypto v0.1.0 // indirect
+)
@@ -1,16 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
+
+	"9pserver/ninep"
 )
 
+const shutdownTimeout = 10 * time.Second
+
+var cowFlag = flag.Bool("c", false, "Keep the changes of each client in memory until it disconnects, leaving fsroot untouched")
 var debugFlag = flag.Bool("d", false, "Enable verbose debugging")
 var listenAddr = flag.String("l", ":564", "Listen `address`")
+var listenNetwork = flag.String("n", "tcp", "Listen `network` (tcp or unix)")
+var qidFile = flag.String("q", "", "Persist qid paths across restarts in `file`")
+var protocolVersion = flag.String("version", "", "Only accept protocol `version` (9P2000 or 9P2000.e) instead of any supported one")
+var selftestAddr = flag.String("selftest", "", "Test the server listening on `address` of network -n instead of serving")
+var stdioFlag = flag.Bool("s", false, "Serve a single session on standard input and output instead of listening")
 
 func usage() {
 	fmt.Printf("Usage: %s fsroot\nOptions:\n", os.Args[0])
@@ -19,18 +35,104 @@ func usage() {
 
 func main() {
 	flag.Parse()
+	if *selftestAddr != "" {
+		conn, err := net.Dial(*listenNetwork, *selftestAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer conn.Close()
+		if !selftest(conn, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
 	args := flag.Args()
 	if len(args) != 1 {
 		usage()
 		os.Exit(1)
 	}
-	listener, err := net.Listen("tcp", *listenAddr)
+	p, err := filepath.Abs(args[0])
 	if err != nil {
 		log.Fatalln(err)
 	}
-	p, err := filepath.Abs(args[0])
+	var fsOpts []ninep.LocalFilesystemOption
+	if *qidFile != "" {
+		fsOpts = append(fsOpts, ninep.WithQidFile(*qidFile))
+	}
+	fs := ninep.NewLocalFilesystem(p, fsOpts...)
+	var serverOpts []ninep.ServerOption
+	if *protocolVersion != "" {
+		opt, err := versionOption(*protocolVersion)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		serverOpts = append(serverOpts, opt)
+	}
+	if *cowFlag {
+		serverOpts = append(serverOpts, ninep.WithSessionFilesystem(ninep.NewCowFilesystem))
+	}
+	if *stdioFlag {
+		err = ninep.NewServer(nil, fs, *debugFlag, serverOpts...).ServeConn(ninep.NewPipeConn(os.Stdin, os.Stdout))
+		closeFilesystem(fs)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	listener, err := net.Listen(*listenNetwork, *listenAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = serveUntilSignal(ninep.NewServer(listener, fs, *debugFlag, serverOpts...), os.Interrupt, syscall.SIGTERM)
+	closeFilesystem(fs)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	NewServer(listener, NewLocalFilesystem(p), *debugFlag).AcceptLoop()
+}
+
+// closeFilesystem closes fs if it has to be closed, which writes the qid paths
+// a local filesystem did not write to its qid file yet.
+func closeFilesystem(fs ninep.Filesystem) {
+	if closer, ok := fs.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// versionOption returns the option making the server accept only version,
+// which must be supported.
+func versionOption(version string) (ninep.ServerOption, error) {
+	if !ninep.IsSupportedVersion(version) {
+		return nil, fmt.Errorf("unsupported protocol version %s", version)
+	}
+	return ninep.WithProtocolVersion(version), nil
+}
+
+// serveUntilSignal runs the accept loop until one of signals is received and
+// then shuts the server down. Closing a unix listener also removes its socket
+// file.
+func serveUntilSignal(server *ninep.Server, signals ...os.Signal) error {
+	ctx, stop := signal.NotifyContext(context.Background(), signals...)
+	defer stop()
+	acceptErr := make(chan error, 1)
+	go func() {
+		acceptErr <- server.AcceptLoop()
+	}()
+	select {
+	case err := <-acceptErr:
+		return err
+	case <-ctx.Done():
+	}
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	if err := <-acceptErr; !errors.Is(err, ninep.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,102 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"9pserver/ninep"
+)
+
+func TestServeUntilSignal(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "9p.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ninep.NewServer(listener, ninep.NewMemFilesystem(), false)
+	result := make(chan error, 1)
+	go func() {
+		result <- serveUntilSignal(server, syscall.SIGUSR1)
+	}()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A version exchange proves the session is up, and so is the signal handler.
+	tversion, err := hex.DecodeString("1300000064FFFF002000000600395032303030")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(tversion); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 19)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+	if _, err := os.Stat(socketPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file still exists: %v", err)
+	}
+	if _, err := net.Dial("unix", socketPath); err == nil {
+		t.Error("listener still accepts connections")
+	}
+}
+
+func TestVersionOption(t *testing.T) {
+	if _, err := versionOption("9P2000.u"); err == nil {
+		t.Error("got no error for an unsupported version")
+	}
+	opt, err := versionOption(ninep.ProtocolVersionE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		_ = ninep.NewServer(nil, ninep.NewMemFilesystem(), false, opt).ServeConn(serverConn)
+	}()
+	for _, tc := range []struct{ version, want string }{
+		{ninep.ProtocolVersion, "unknown"},
+		{ninep.ProtocolVersionE, ninep.ProtocolVersionE},
+	} {
+		if err := ninep.SerializeMessage(clientConn, &ninep.Tversion{Tag: 0xFFFF, Msize: ninep.MaximumMsgSize, Version: tc.version}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := ninep.DeserializeMessage(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rversion, ok := msg.(*ninep.Rversion); !ok || rversion.Version != tc.want {
+			t.Errorf("%s: got %v, want version %s", tc.version, msg, tc.want)
+		}
+	}
+}
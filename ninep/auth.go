@@ -0,0 +1,50 @@
+package ninep
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Authenticator performs the authentication protocol spoken over an afid.
+type Authenticator interface {
+	// Start begins authenticating uname for attaching aname.
+	Start(uname string, aname string) (Auth, error)
+}
+
+// Authorizer decides which clients may attach, after they authenticated if
+// an Authenticator is used too.
+type Authorizer interface {
+	// Authorize returns nil if the client on conn may attach aname as uname.
+	// Attaches it returns an error for are rejected as permission denied.
+	Authorize(conn ConnInfo, uname string, aname string) error
+}
+
+// OperationAuthorizer is an Authorizer which is also asked before a client
+// opens, creates, removes or changes the stat of a file.
+type OperationAuthorizer interface {
+	Authorizer
+	// AuthorizeOperation returns nil if uname, who attached the fid used, may
+	// do the operation of the T-message of type mtype on path.
+	AuthorizeOperation(conn ConnInfo, uname string, mtype uint8, path string) error
+}
+
+// ConnInfo describes the connection of a client.
+type ConnInfo struct {
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+	// TLS is the state of the connection if it uses TLS, or nil.
+	TLS *tls.ConnectionState
+}
+
+// Auth is the state of a single authentication exchange. Reads and writes of
+// the afid are passed to it unchanged.
+type Auth interface {
+	Read(count uint32) ([]byte, error)
+	Write(data []byte) error
+	// Authenticated reports whether the exchange has completed successfully.
+	Authenticated() bool
+}
@@ -0,0 +1,219 @@
+package ninep
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	p "path"
+	"testing"
+	"time"
+)
+
+type echoAuthenticator struct{}
+
+type echoAuth struct {
+	challenge string
+	done      bool
+}
+
+func (echoAuthenticator) Start(uname string, aname string) (Auth, error) {
+	return &echoAuth{challenge: "challenge-" + uname}, nil
+}
+
+func (a *echoAuth) Read(count uint32) ([]byte, error) {
+	return []byte(a.challenge), nil
+}
+
+func (a *echoAuth) Write(data []byte) error {
+	if string(data) != "response-"+a.challenge {
+		return ErrAuthFailed
+	}
+	a.done = true
+	return nil
+}
+
+func (a *echoAuth) Authenticated() bool {
+	return a.done
+}
+
+func TestAuthenticatedAttach(t *testing.T) {
+	c := newTestClient(t, NewMemFilesystem(), WithAuthenticator(echoAuthenticator{}))
+	c.version()
+
+	err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "glenda"}, &Rattach{})
+	if err != rerror(EAuthFailedStr) {
+		t.Fatalf("got %v, want %v", err, EAuthFailedStr)
+	}
+
+	var rauth Rauth
+	err = c.rpc(&Tauth{Tag: 2, Afid: 5, Uname: "glenda"}, &rauth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rauth.Aqid.Ftype&QTAUTH == 0 {
+		t.Errorf("got qid type %#x, want QTAUTH", rauth.Aqid.Ftype)
+	}
+	err = c.rpc(&Tattach{Tag: 3, Fid: 0, Afid: 5, Uname: "glenda"}, &Rattach{})
+	if err != rerror(EAuthFailedStr) {
+		t.Fatalf("got %v before authenticating, want %v", err, EAuthFailedStr)
+	}
+
+	var rread Rread
+	err = c.rpc(&Tread{Tag: 4, Fid: 5, Count: 64}, &rread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rread.Data) != "challenge-glenda" {
+		t.Fatalf("got '%s', want '%s'", rread.Data, "challenge-glenda")
+	}
+	var rwrite Rwrite
+	err = c.rpc(&Twrite{Tag: 5, Fid: 5, Data: []byte("response-" + string(rread.Data))}, &rwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.rpc(&Tattach{Tag: 6, Fid: 0, Afid: 5, Uname: "someone-else"}, &Rattach{})
+	if err != rerror(EAuthFailedStr) {
+		t.Fatalf("got %v for a different uname, want %v", err, EAuthFailedStr)
+	}
+	err = c.rpc(&Tattach{Tag: 7, Fid: 0, Afid: 5, Uname: "glenda"}, &Rattach{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.rpc(&Tstat{Tag: 8, Fid: 0}, &Rstat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type recordingAuthorizer struct {
+	conns chan ConnInfo
+}
+
+func (a recordingAuthorizer) Authorize(conn ConnInfo, uname string, aname string) error {
+	a.conns <- conn
+	if uname != "glenda" {
+		return errors.New("unknown user")
+	}
+	return nil
+}
+
+func newTestCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAttachAfidWithoutAuth(t *testing.T) {
+	c := newTestClient(t, NewMemFilesystem())
+	c.version()
+	err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: 5, Uname: "glenda"}, &Rattach{})
+	if err != rerror(ENoAuthRequiredStr) {
+		t.Errorf("got %v, want %v", err, ENoAuthRequiredStr)
+	}
+	if err := c.rpc(&Tattach{Tag: 2, Fid: 0, Afid: NOFID, Uname: "glenda"}, &Rattach{}); err != nil {
+		t.Errorf("got %v, want the attach without afid to succeed", err)
+	}
+}
+
+func TestAuthorizerConnInfo(t *testing.T) {
+	authorizer := recordingAuthorizer{make(chan ConnInfo, 2)}
+	server := NewServer(nil, NewMemFilesystem(), false, WithAuthorizer(authorizer))
+	clientConn, serverConn := net.Pipe()
+	serverTLS := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "server")},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	go newSession(server, serverTLS).loop()
+	clientTLS := tls.Client(clientConn, &tls.Config{
+		Certificates:       []tls.Certificate{newTestCertificate(t, "glenda's laptop")},
+		InsecureSkipVerify: true,
+	})
+	defer clientTLS.Close()
+	c := &testClient{t, clientTLS}
+	c.version()
+
+	err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "glenda"}, &Rattach{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := <-authorizer.conns
+	if info.TLS == nil || len(info.TLS.PeerCertificates) == 0 {
+		t.Fatalf("got %+v, want the TLS state of the connection", info)
+	}
+	if name := info.TLS.PeerCertificates[0].Subject.CommonName; name != "glenda's laptop" {
+		t.Errorf("got subject '%s', want '%s'", name, "glenda's laptop")
+	}
+	if info.RemoteAddr == nil || info.ConnectedAt.IsZero() {
+		t.Errorf("got %+v, want the remote address and connection time", info)
+	}
+
+	err = c.rpc(&Tattach{Tag: 1, Fid: 1, Afid: NOFID, Uname: "bob"}, &Rattach{})
+	if err != rerror(EPermissionDeniedStr) {
+		t.Errorf("got %v, want %v", err, EPermissionDeniedStr)
+	}
+}
+
+// ownerAuthorizer lets users change only the files named after them.
+type ownerAuthorizer struct{}
+
+func (ownerAuthorizer) Authorize(conn ConnInfo, uname string, aname string) error {
+	return nil
+}
+
+func (ownerAuthorizer) AuthorizeOperation(conn ConnInfo, uname string, mtype uint8, path string) error {
+	if mtype != TopenType && p.Base(path) != uname {
+		return errors.New("not the owner")
+	}
+	return nil
+}
+
+func TestOperationAuthorizer(t *testing.T) {
+	fs := NewMemFilesystem()
+	for _, name := range []string{"/glenda", "/bob"} {
+		if err := fs.CreateFile(name, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestClient(t, fs, WithAuthorizer(ownerAuthorizer{}))
+	c.version()
+	if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "glenda"}, &Rattach{}); err != nil {
+		t.Fatal(err)
+	}
+	for fid, name := range map[uint32]string{1: "glenda", 2: "bob"} {
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: fid, Nwname: []string{name}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 2, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Errorf("got %v, want glenda to open bob", err)
+	}
+	if err := c.rpc(&Tremove{Tag: 1, Fid: 2}, &Rremove{}); err != rerror(EPermissionDeniedStr) {
+		t.Errorf("got %v, want %v", err, EPermissionDeniedStr)
+	}
+	if err := c.rpc(&Tremove{Tag: 1, Fid: 1}, &Rremove{}); err != nil {
+		t.Errorf("got %v, want glenda to remove glenda", err)
+	}
+	if _, err := fs.Stat("/bob"); err != nil {
+		t.Errorf("got %v, want bob to stay", err)
+	}
+}
@@ -0,0 +1,146 @@
+package ninep
+
+import (
+	p "path"
+	"strings"
+)
+
+// caseInsensitiveFilesystem finds the files of another filesystem by names
+// differing from theirs only in case, for clients from systems where names
+// are case-insensitive. Names are matched exactly whenever possible, a
+// directory is only scanned for a name with no exact match.
+type caseInsensitiveFilesystem struct {
+	inner Filesystem
+}
+
+// NewCaseInsensitiveFilesystem returns a filesystem serving inner, in which a
+// name missing from a directory of inner names the file whose name only
+// differs from it in case. Names matching several files fail with
+// ErrAmbiguousName. Looking names up costs a directory scan when they are not
+// found exactly.
+func NewCaseInsensitiveFilesystem(inner Filesystem) Filesystem {
+	return &caseInsensitiveFilesystem{inner}
+}
+
+// resolve returns the path in inner of the file named by path.
+func (f *caseInsensitiveFilesystem) resolve(path string) (string, error) {
+	path = p.Clean("/" + path)
+	_, err := f.inner.Stat(path)
+	if err != ErrDoesNotExist {
+		return path, err
+	}
+	resolved := "/"
+	for _, name := range strings.Split(path, "/")[1:] {
+		next := p.Join(resolved, name)
+		_, err := f.inner.Stat(next)
+		if err == nil {
+			resolved = next
+			continue
+		}
+		if err != ErrDoesNotExist {
+			return "", err
+		}
+		stats, err := f.inner.ReadDir(resolved)
+		if err != nil {
+			return "", err
+		}
+		match := ""
+		for _, stat := range stats {
+			if strings.EqualFold(stat.Name, name) {
+				if match != "" {
+					return "", ErrAmbiguousName
+				}
+				match = stat.Name
+			}
+		}
+		if match == "" {
+			return "", ErrDoesNotExist
+		}
+		resolved = p.Join(resolved, match)
+	}
+	return resolved, nil
+}
+
+func (f *caseInsensitiveFilesystem) Open(path string, mode uint8) (File, error) {
+	path, err := f.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.inner.Open(path, mode)
+}
+
+func (f *caseInsensitiveFilesystem) CreateDir(path string, perm uint32) error {
+	return f.create(path, perm, f.inner.CreateDir)
+}
+
+func (f *caseInsensitiveFilesystem) CreateFile(path string, perm uint32) error {
+	return f.create(path, perm, f.inner.CreateFile)
+}
+
+// create makes a file in the directory of path, unless it would only differ
+// from an existing name in case.
+func (f *caseInsensitiveFilesystem) create(path string, perm uint32, create func(string, uint32) error) error {
+	path = p.Clean("/" + path)
+	_, err := f.resolve(path)
+	if err == nil {
+		return ErrAlreadyExists
+	}
+	if err != ErrDoesNotExist {
+		return err
+	}
+	dir, err := f.resolve(p.Dir(path))
+	if err != nil {
+		return err
+	}
+	return create(p.Join(dir, p.Base(path)), perm)
+}
+
+func (f *caseInsensitiveFilesystem) ReadDir(path string) ([]Stat, error) {
+	path, err := f.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.inner.ReadDir(path)
+}
+
+func (f *caseInsensitiveFilesystem) Remove(path string) error {
+	path, err := f.resolve(path)
+	if err != nil {
+		return err
+	}
+	return f.inner.Remove(path)
+}
+
+func (f *caseInsensitiveFilesystem) Stat(path string) (Stat, error) {
+	path, err := f.resolve(path)
+	if err != nil {
+		return Stat{}, err
+	}
+	return f.inner.Stat(path)
+}
+
+func (f *caseInsensitiveFilesystem) Wstat(path string, stat Stat) error {
+	path, err := f.resolve(path)
+	if err != nil {
+		return err
+	}
+	return f.inner.Wstat(path, stat)
+}
+
+func (f *caseInsensitiveFilesystem) Readlink(path string) (string, error) {
+	path, err := f.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	return readlink(f.inner, path)
+}
+
+func (f *caseInsensitiveFilesystem) SetMuid(path string, uname string) {
+	setter, ok := f.inner.(MuidSetter)
+	if !ok {
+		return
+	}
+	if path, err := f.resolve(path); err == nil {
+		setter.SetMuid(path, uname)
+	}
+}
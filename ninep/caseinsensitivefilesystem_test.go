@@ -0,0 +1,56 @@
+package ninep
+
+import (
+	"testing"
+)
+
+func TestCaseInsensitiveFilesystem(t *testing.T) {
+	inner := NewMemFilesystem()
+	if err := inner.CreateDir("/Dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, inner, "/Dir/foo.txt", "foo")
+	writeMemFile(t, inner, "/Dir/same", "lower")
+	writeMemFile(t, inner, "/Dir/SAME", "upper")
+
+	c := newTestClient(t, NewCaseInsensitiveFilesystem(inner))
+	c.attach(0)
+	for i, test := range []struct {
+		walk []string
+		name string
+		err  error
+	}{
+		{[]string{"dir", "Foo.TXT"}, "foo.txt", nil},
+		{[]string{"Dir", "same"}, "same", nil},
+		{[]string{"Dir", "SAME"}, "SAME", nil},
+		{[]string{"dir", "Same"}, "", rerror(EAmbiguousNameStr)},
+		{[]string{"dir", "missing"}, "", rerror(ENoSuchFileOrDirectoryStr)},
+	} {
+		fid := uint32(i + 1)
+		err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: fid, Nwname: test.walk}, &Rwalk{})
+		if err != test.err {
+			t.Errorf("%v: got %v, want %v", test.walk, err, test.err)
+		}
+		if err != nil {
+			continue
+		}
+		var rstat Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: fid}, &rstat); err != nil {
+			t.Fatal(err)
+		}
+		if rstat.Stat.Name != test.name {
+			t.Errorf("%v: got %s, want %s", test.walk, rstat.Stat.Name, test.name)
+		}
+	}
+
+	fs := NewCaseInsensitiveFilesystem(inner)
+	if err := fs.CreateFile("/DIR/FOO.txt", 0644); err != ErrAlreadyExists {
+		t.Errorf("got %v, want %v", err, ErrAlreadyExists)
+	}
+	if err := fs.CreateFile("/DIR/new", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inner.Stat("/Dir/new"); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
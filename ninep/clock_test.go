@@ -0,0 +1,152 @@
+package ninep
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only passes when advance is called.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	when    time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the time d forward and calls the functions of the timers
+// which expire.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	var expired []func()
+	for _, t := range c.timers {
+		if !t.stopped && !t.when.After(c.now) {
+			t.stopped = true
+			expired = append(expired, t.f)
+		}
+	}
+	c.mutex.Unlock()
+	for _, f := range expired {
+		f()
+	}
+}
+
+// waitForTimers waits until n timers were started.
+func (c *fakeClock) waitForTimers(n int) {
+	for i := 0; i < 500; i++ {
+		c.mutex.Lock()
+		started := len(c.timers)
+		c.mutex.Unlock()
+		if started >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := !t.stopped
+	t.stopped = false
+	t.when = t.clock.now.Add(d)
+	return active
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	c := newTestClient(t, NewMemFilesystem(), WithClock(clock), WithIdleTimeout(time.Minute))
+	c.attach(0)
+	clock.advance(50 * time.Second)
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 0}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+	// The Tstat restarted the timeout.
+	clock.advance(50 * time.Second)
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 0}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	clock := newFakeClock()
+	c := newTestClient(t, NewMemFilesystem(), WithClock(clock), WithHandshakeTimeout(time.Second), WithIdleTimeout(time.Minute))
+	c.attach(0)
+	// Once the version is negotiated, the idle timeout applies.
+	clock.advance(50 * time.Second)
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 0}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+
+	silent := newTestClient(t, NewMemFilesystem(), WithClock(clock), WithHandshakeTimeout(time.Second), WithIdleTimeout(time.Minute))
+	clock.waitForTimers(2)
+	clock.advance(time.Second)
+	_ = silent.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := silent.conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestMemFilesystemClock(t *testing.T) {
+	clock := newFakeClock()
+	fs := NewMemFilesystem(WithMemClock(clock))
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Hour)
+	file, err := fs.Open("/file", OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Write(0, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint32(clock.Now().Unix()); stat.Mtime != want {
+		t.Errorf("got mtime %d, want %d", stat.Mtime, want)
+	}
+}
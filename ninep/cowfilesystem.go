@@ -0,0 +1,302 @@
+package ninep
+
+import (
+	p "path"
+	"sort"
+	"sync"
+)
+
+// overlayQidBit is set in the qid paths of files in the overlay of a
+// cowFilesystem, so they never collide with the qid paths of the base.
+const overlayQidBit = 1 << 63
+
+// cowFilesystem presents a base filesystem which is never modified. Files are
+// copied into an in-memory overlay when they are changed, and removed files of
+// the base are hidden by whiteouts.
+type cowFilesystem struct {
+	base    Filesystem
+	overlay Filesystem
+
+	mutex     sync.Mutex
+	whiteouts map[string]bool
+}
+
+// cowFile is a File of the overlay of a cowFilesystem.
+type cowFile struct {
+	File
+}
+
+// NewCowFilesystem returns a filesystem which reads through to base but keeps
+// every change in memory, leaving base untouched.
+func NewCowFilesystem(base Filesystem) Filesystem {
+	return &cowFilesystem{base: base, overlay: NewMemFilesystem(), whiteouts: make(map[string]bool)}
+}
+
+func (f *cowFilesystem) Open(path string, mode uint8) (File, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path = p.Clean("/" + path)
+	if _, err := f.overlay.Stat(path); err == nil {
+		return f.openOverlay(path, mode)
+	}
+	if f.hidden(path) {
+		return nil, ErrDoesNotExist
+	}
+	if mode&3 == OWRITE || mode&3 == ORDWR || mode&OTRUNC != 0 {
+		err := f.copyUp(path)
+		if err != nil {
+			return nil, err
+		}
+		return f.openOverlay(path, mode)
+	}
+	return f.base.Open(path, mode)
+}
+
+func (f *cowFilesystem) CreateDir(path string, perm uint32) error {
+	return f.create(path, perm, f.overlay.CreateDir)
+}
+
+func (f *cowFilesystem) CreateFile(path string, perm uint32) error {
+	return f.create(path, perm, f.overlay.CreateFile)
+}
+
+func (f *cowFilesystem) ReadDir(path string) ([]Stat, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.readDir(p.Clean("/" + path))
+}
+
+func (f *cowFilesystem) Remove(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path = p.Clean("/" + path)
+	if path == "/" {
+		return ErrPermissionDenied
+	}
+	stat, err := f.stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode&DMDIR != 0 {
+		entries, err := f.readDir(path)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			return ErrDirectoryNotEmpty
+		}
+	}
+	if _, err := f.overlay.Stat(path); err == nil {
+		err = f.overlay.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := f.base.Stat(path); err == nil {
+		f.whiteouts[path] = true
+	}
+	return nil
+}
+
+func (f *cowFilesystem) Stat(path string) (Stat, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.stat(p.Clean("/" + path))
+}
+
+// Readlink reads links from the base, since the overlay cannot hold them.
+func (f *cowFilesystem) Readlink(path string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path = p.Clean("/" + path)
+	if _, err := f.overlay.Stat(path); err == nil {
+		return readlink(f.overlay, path)
+	}
+	if f.hidden(path) {
+		return "", ErrDoesNotExist
+	}
+	return readlink(f.base, path)
+}
+
+func (f *cowFilesystem) Wstat(path string, stat Stat) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path = p.Clean("/" + path)
+	if _, err := f.stat(path); err != nil {
+		return err
+	}
+	// Renaming in the overlay would leave the file under its old name in
+	// base.
+	if stat.Name != "" {
+		return ErrNotSupported
+	}
+	err := f.copyUp(path)
+	if err != nil {
+		return err
+	}
+	return f.overlay.Wstat(path, stat)
+}
+
+func (f *cowFilesystem) SetMuid(path string, uname string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if setter, ok := f.overlay.(MuidSetter); ok {
+		setter.SetMuid(p.Clean("/"+path), uname)
+	}
+}
+
+func (f *cowFilesystem) create(path string, perm uint32, create func(string, uint32) error) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path = p.Clean("/" + path)
+	if _, err := f.stat(path); err == nil {
+		return ErrAlreadyExists
+	}
+	parent, err := f.stat(p.Dir(path))
+	if err != nil || parent.Mode&DMDIR == 0 {
+		return ErrDoesNotExist
+	}
+	err = f.copyUp(p.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = create(path, perm)
+	if err != nil {
+		return err
+	}
+	delete(f.whiteouts, path)
+	return nil
+}
+
+func (f *cowFilesystem) openOverlay(path string, mode uint8) (File, error) {
+	file, err := f.overlay.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return cowFile{file}, nil
+}
+
+// hidden reports whether path or one of its parents was removed from the base.
+func (f *cowFilesystem) hidden(path string) bool {
+	for ; path != "/"; path = p.Dir(path) {
+		if f.whiteouts[path] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *cowFilesystem) stat(path string) (Stat, error) {
+	stat, err := f.overlay.Stat(path)
+	if err == nil {
+		stat.Qid.Path |= overlayQidBit
+		return stat, nil
+	}
+	if f.hidden(path) {
+		return Stat{}, ErrDoesNotExist
+	}
+	return f.base.Stat(path)
+}
+
+func (f *cowFilesystem) readDir(path string) ([]Stat, error) {
+	stat, err := f.stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Mode&DMDIR == 0 {
+		return nil, ErrIOError
+	}
+	entries := make(map[string]Stat)
+	if _, err := f.base.Stat(path); err == nil && !f.hidden(path) {
+		stats, err := f.base.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, stat := range stats {
+			if !f.whiteouts[p.Join(path, stat.Name)] {
+				entries[stat.Name] = stat
+			}
+		}
+	}
+	if _, err := f.overlay.Stat(path); err == nil {
+		stats, err := f.overlay.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, stat := range stats {
+			stat.Qid.Path |= overlayQidBit
+			entries[stat.Name] = stat
+		}
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]Stat, len(names))
+	for i, name := range names {
+		stats[i] = entries[name]
+	}
+	return stats, nil
+}
+
+// copyUp copies the file at path and its parent directories from the base into
+// the overlay, unless they are there already.
+func (f *cowFilesystem) copyUp(path string) error {
+	if _, err := f.overlay.Stat(path); err == nil {
+		return nil
+	}
+	err := f.copyUp(p.Dir(path))
+	if err != nil {
+		return err
+	}
+	stat, err := f.base.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode&DMDIR != 0 {
+		return f.overlay.CreateDir(path, stat.Mode)
+	}
+	err = f.overlay.CreateFile(path, stat.Mode&^DMAPPEND)
+	if err != nil {
+		return err
+	}
+	src, err := f.base.Open(path, OREAD)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := f.overlay.Open(path, OWRITE)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	var offset uint64
+	for {
+		data, err := src.Read(offset, MaximumMsgSize)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			break
+		}
+		err = dst.Write(offset, data)
+		if err != nil {
+			return err
+		}
+		offset += uint64(len(data))
+	}
+	return f.overlay.Wstat(path, Stat{Mode: stat.Mode, Length: ^uint64(0)})
+}
+
+func (f cowFile) Qid() Qid {
+	qid := f.File.Qid()
+	qid.Path |= overlayQidBit
+	return qid
+}
+
+func (f cowFile) Stat() (Stat, error) {
+	stat, err := f.File.Stat()
+	stat.Qid.Path |= overlayQidBit
+	return stat, err
+}
@@ -0,0 +1,120 @@
+package ninep
+
+import (
+	"testing"
+)
+
+func writeMemFile(t *testing.T, fs Filesystem, path string, content string) {
+	t.Helper()
+	if err := fs.CreateFile(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open(path, OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Write(0, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMemFile(t *testing.T, fs Filesystem, path string) string {
+	t.Helper()
+	file, err := fs.Open(path, OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := file.Read(0, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCowFilesystem(t *testing.T) {
+	base := NewMemFilesystem()
+	if err := base.CreateDir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, base, "/dir/file", "base content")
+	writeMemFile(t, base, "/removed", "x")
+
+	fs := NewCowFilesystem(base)
+	file, err := fs.Open("/dir/file", ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Write(0, []byte("overlay")); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	writeMemFile(t, fs, "/dir/new", "new")
+	if err := fs.Remove("/removed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readMemFile(t, fs, "/dir/file"); got != "overlayntent" {
+		t.Errorf("got '%s', want '%s'", got, "overlayntent")
+	}
+	if got := readMemFile(t, base, "/dir/file"); got != "base content" {
+		t.Errorf("got '%s', want '%s'", got, "base content")
+	}
+	if _, err := base.Stat("/dir/new"); err != ErrDoesNotExist {
+		t.Errorf("got %v, want %v", err, ErrDoesNotExist)
+	}
+	if _, err := fs.Stat("/removed"); err != ErrDoesNotExist {
+		t.Errorf("got %v, want %v", err, ErrDoesNotExist)
+	}
+	if _, err := base.Stat("/removed"); err != nil {
+		t.Errorf("got %v, want the base file to stay", err)
+	}
+
+	stats, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != "dir" {
+		t.Errorf("got %+v, want only 'dir'", stats)
+	}
+	stats, err = fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Name != "file" || stats[0].Length != 12 || stats[1].Name != "new" {
+		t.Errorf("got %+v, want 'file' of 12 bytes and 'new'", stats)
+	}
+
+	if err := fs.CreateFile("/removed", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, fs, "/removed"); got != "" {
+		t.Errorf("got '%s', want a recreated empty file", got)
+	}
+
+	if err := fs.Wstat("/dir/file", Stat{Mode: ^uint32(0), Length: ^uint64(0), Name: "renamed"}); err != ErrNotSupported {
+		t.Errorf("got %v, want %v", err, ErrNotSupported)
+	}
+}
+
+func TestSessionFilesystemResets(t *testing.T) {
+	base := NewMemFilesystem()
+	writeMemFile(t, base, "/file", "base")
+	server := NewServer(nil, base, false, WithSessionFilesystem(NewCowFilesystem))
+
+	first := newSession(server, nil)
+	file, err := first.filesystem.Open("/file", OTRUNC|OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if got := readMemFile(t, first.filesystem, "/file"); got != "" {
+		t.Errorf("got '%s', want the file truncated", got)
+	}
+
+	second := newSession(server, nil)
+	if got := readMemFile(t, second.filesystem, "/file"); got != "base" {
+		t.Errorf("got '%s', want '%s'", got, "base")
+	}
+}
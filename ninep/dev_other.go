@@ -0,0 +1,11 @@
+//go:build !unix
+
+package ninep
+
+import (
+	"os"
+)
+
+func fileDev(fileInfo os.FileInfo) uint32 {
+	return 0
+}
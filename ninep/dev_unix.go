@@ -0,0 +1,15 @@
+//go:build unix
+
+package ninep
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileDev(fileInfo os.FileInfo) uint32 {
+	if st, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return uint32(st.Dev)
+	}
+	return 0
+}
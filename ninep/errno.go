@@ -0,0 +1,43 @@
+//go:build !plan9
+
+package ninep
+
+import (
+	"errors"
+	"syscall"
+)
+
+// The Unix error numbers sent along with the errors of the protocol.
+const (
+	errnoEIO        = syscall.EIO
+	errnoENOENT     = syscall.ENOENT
+	errnoEBADF      = syscall.EBADF
+	errnoEEXIST     = syscall.EEXIST
+	errnoENOTEMPTY  = syscall.ENOTEMPTY
+	errnoEACCES     = syscall.EACCES
+	errnoENOTDIR    = syscall.ENOTDIR
+	errnoELOOP      = syscall.ELOOP
+	errnoEINVAL     = syscall.EINVAL
+	errnoEPERM      = syscall.EPERM
+	errnoEOPNOTSUPP = syscall.EOPNOTSUPP
+	errnoEXDEV      = syscall.EXDEV
+	errnoENOSPC     = syscall.ENOSPC
+	errnoESTALE     = syscall.ESTALE
+	errnoEDQUOT     = syscall.EDQUOT
+)
+
+// errnoError translates the errors of the host with an error number which has
+// a counterpart among the errors of this package, or returns nil.
+func errnoError(err error) error {
+	switch {
+	// The operating system gives up resolving symbolic links after a bounded
+	// number of them, so loops end with ELOOP.
+	case errors.Is(err, syscall.ELOOP):
+		return ErrSymlinkLoop
+	case errors.Is(err, syscall.EXDEV):
+		return ErrCrossDevice
+	case errors.Is(err, syscall.ENOSPC):
+		return ErrNoSpace
+	}
+	return nil
+}
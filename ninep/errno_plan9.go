@@ -0,0 +1,30 @@
+package ninep
+
+import (
+	"syscall"
+)
+
+// Plan 9 has no error numbers, so the errors of the protocol go without.
+const (
+	errnoEIO        syscall.Errno = 0
+	errnoENOENT     syscall.Errno = 0
+	errnoEBADF      syscall.Errno = 0
+	errnoEEXIST     syscall.Errno = 0
+	errnoENOTEMPTY  syscall.Errno = 0
+	errnoEACCES     syscall.Errno = 0
+	errnoENOTDIR    syscall.Errno = 0
+	errnoELOOP      syscall.Errno = 0
+	errnoEINVAL     syscall.Errno = 0
+	errnoEPERM      syscall.Errno = 0
+	errnoEOPNOTSUPP syscall.Errno = 0
+	errnoEXDEV      syscall.Errno = 0
+	errnoENOSPC     syscall.Errno = 0
+	errnoESTALE     syscall.Errno = 0
+	errnoEDQUOT     syscall.Errno = 0
+)
+
+// errnoError returns nil, errors are strings on Plan 9 and the ones it has are
+// translated by osError.
+func errnoError(err error) error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package ninep
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+)
+
+type Filesystem interface {
+	Open(path string, mode uint8) (File, error)
+	CreateDir(path string, perm uint32) error
+	CreateFile(path string, perm uint32) error
+	ReadDir(path string) ([]Stat, error)
+	Remove(path string) error
+	Stat(path string) (Stat, error)
+	// Wstat changes the fields of stat which are not set to be left alone. A
+	// non-empty Name is a new name for the file within its directory.
+	Wstat(path string, stat Stat) error
+}
+
+// ReadlinkFilesystem is implemented by filesystems with symbolic links.
+// Readlink returns the target of the link at path, without following it.
+type ReadlinkFilesystem interface {
+	Readlink(path string) (string, error)
+}
+
+// LimitedDirReader is implemented by filesystems which can stop reading a
+// directory after some of its entries. ReadDirLimit is ReadDir returning at
+// most max entries, and whether the directory has more. Which entries are
+// returned when it has more is up to the filesystem, they need not be the
+// first max of the whole listing.
+type LimitedDirReader interface {
+	ReadDirLimit(path string, max int) ([]Stat, bool, error)
+}
+
+// readlink reads the symbolic link at path of fs, or fails with
+// ErrNotSupported if fs has none.
+func readlink(fs Filesystem, path string) (string, error) {
+	if linker, ok := fs.(ReadlinkFilesystem); ok {
+		return linker.Readlink(path)
+	}
+	return "", ErrNotSupported
+}
+
+// MuidSetter is implemented by filesystems which report the last user who
+// modified a file in Stat.Muid. The server calls SetMuid after every change a
+// client makes.
+type MuidSetter interface {
+	SetMuid(path string, uname string)
+}
+
+// UserFilesystem is implemented by filesystems which depend on the user making
+// a request. The server operates on the filesystem ForUser returns for the
+// uname a fid was attached with.
+type UserFilesystem interface {
+	ForUser(uname string) Filesystem
+}
+
+type File interface {
+	Qid() Qid
+	IsDir() bool
+	Stat() (Stat, error)
+	Read(offset uint64, count uint32) ([]byte, error)
+	// Write replaces the bytes at offset and leaves the rest of the file as
+	// it is, it never makes a file shorter. Clients shrink files by opening
+	// them with OTRUNC or by setting their length with Wstat.
+	Write(offset uint64, data []byte) error
+	// Sync commits the data written so far to stable storage.
+	Sync() error
+	Close()
+}
+
+// ReaderAtFile is implemented by Files which can also be read as an
+// io.ReaderAt. The server then reads the data of an Rread straight into the
+// reply instead of copying it from the slice Read returns.
+type ReaderAtFile interface {
+	File
+	io.ReaderAt
+}
+
+var ErrDoesNotExist = errors.New("no such file or directory")
+var ErrIOError = errors.New("i/o error")
+var ErrAlreadyExists = errors.New("file or directory already exists")
+var ErrDirectoryNotEmpty = errors.New("directory not empty")
+var ErrPermissionDenied = errors.New("permission denied")
+var ErrNotDirectory = errors.New("not a directory")
+var ErrSymlinkLoop = errors.New("symbolic link loop")
+
+// ErrUnknownUser is returned when a user or group name does not name one the
+// filesystem knows.
+var ErrUnknownUser = errors.New("unknown user or group")
+
+// ErrCrossDevice is returned when a file would be moved to another device,
+// which filesystems refuse rather than copying it.
+var ErrCrossDevice = errors.New("cannot rename across devices")
+
+// ErrAmbiguousName is returned when a name matches several files, none of them
+// exactly.
+var ErrAmbiguousName = errors.New("name matches several files")
+
+// ErrNoSpace is returned when the device holding a filesystem is full.
+var ErrNoSpace = errors.New("no space left on device")
+
+// ErrStaleSnapshot is returned when a file of a snapshot changed after the
+// snapshot was taken and its old contents can no longer be read.
+var ErrStaleSnapshot = errors.New("file changed since the snapshot")
+
+// Snapshotter is implemented by filesystems which can copy themselves, so a
+// snapshot of them keeps serving their old contents after they change.
+type Snapshotter interface {
+	Snapshot() Filesystem
+}
+
+// PartialWriteError is returned by File.Write when an error happened after some
+// of the data was written. The client is told how much was written, as 9P
+// requires, instead of receiving the error.
+type PartialWriteError struct {
+	Written int
+	Err     error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("wrote %d bytes: %v", e.Written, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// NineError is an error whose message is sent to the client as the text of
+// its Rerror. Backends return it for errors this package has no sentinel for.
+// Errno is the corresponding Unix error number, or zero if there is none.
+type NineError struct {
+	Msg   string
+	Errno syscall.Errno
+}
+
+func (e *NineError) Error() string {
+	return e.Msg
+}
+
+// qidType returns the qid type byte corresponding to the DM* bits of mode.
+func qidType(mode uint32) uint8 {
+	return uint8(mode>>24) & (QTDIR | QTAPPEND | QTEXCL | QTMOUNT | QTAUTH | QTTMP | QTSYMLINK)
+}
+
+var syntheticDevCounter uint32
+
+// newSyntheticDev returns a Stat.Dev value for a filesystem not backed by a
+// device, distinct from the value of every other such filesystem.
+func newSyntheticDev() uint32 {
+	return atomic.AddUint32(&syntheticDevCounter, 1)
+}
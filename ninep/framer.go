@@ -0,0 +1,55 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Framer reads and writes the frames carrying messages on a connection. A
+// frame holds the type, tag and fields of a message.
+type Framer interface {
+	ReadFrame(r io.Reader) ([]byte, error)
+	WriteFrame(w io.Writer, frame []byte) error
+}
+
+// sizePrefixFramer is the framing of 9P, each frame is preceded by its size,
+// including the size itself, as a little-endian uint32.
+type sizePrefixFramer struct{}
+
+var errFrameTooShort = errors.New("frame too short")
+
+// WithFramer makes the server use f instead of the standard 9P framing, for
+// transports which delimit messages differently.
+func WithFramer(f Framer) ServerOption {
+	return func(s *Server) {
+		s.framer = f
+	}
+}
+
+func (sizePrefixFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	size, err := readUint[uint32](r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 5 {
+		return nil, errFrameTooShort
+	}
+	b := make([]byte, size-4)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (sizePrefixFramer) WriteFrame(w io.Writer, frame []byte) error {
+	b := getBuffer()
+	defer putBuffer(b)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(frame)+4))
+	b.Write(size[:])
+	b.Write(frame)
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,69 @@
+package ninep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// bigEndianFramer prefixes frames with their size, excluding the size itself,
+// as a big-endian uint16.
+type bigEndianFramer struct{}
+
+func (bigEndianFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	var size uint16
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func (bigEndianFramer) WriteFrame(w io.Writer, frame []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint16(len(frame)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+func TestFramer(t *testing.T) {
+	server := NewServer(nil, NewMemFilesystem(), false, WithFramer(bigEndianFramer{}))
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newSession(server, serverConn).loop()
+
+	b := new(bytes.Buffer)
+	err := marshalMessage(b, &Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: ProtocolVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bigEndianFramer{}.WriteFrame(clientConn, b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := bigEndianFramer{}.ReadFrame(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := unmarshalMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rversion, ok := msg.(*Rversion)
+	if !ok || rversion.Version != ProtocolVersion || rversion.Msize != MaximumMsgSize {
+		t.Errorf("got %+v, want an Rversion for %s", msg, ProtocolVersion)
+	}
+}
+
+func TestSizePrefixFramerTooShort(t *testing.T) {
+	_, err := sizePrefixFramer{}.ReadFrame(bytes.NewReader([]byte{3, 0, 0, 0}))
+	if err != errFrameTooShort {
+		t.Errorf("got %v, want %v", err, errFrameTooShort)
+	}
+}
@@ -0,0 +1,75 @@
+package ninep
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultMaxDirListingBytes is the number of bytes of directory listings a
+// session holds by default.
+const DefaultMaxDirListingBytes = 16 << 20
+
+// dirListingCache holds the directory listings of the open fids of a session,
+// evicting the least recently used ones when they add up to more than capacity
+// bytes. The listing put last is kept even if it alone is larger than that.
+type dirListingCache struct {
+	mutex    sync.Mutex
+	capacity int
+	size     int
+	order    *list.List
+	entries  map[uint32]*list.Element
+}
+
+type dirListingCacheEntry struct {
+	fid     uint32
+	listing []byte
+}
+
+func newDirListingCache(capacity int) *dirListingCache {
+	return &dirListingCache{capacity: capacity, order: list.New(), entries: make(map[uint32]*list.Element)}
+}
+
+func (c *dirListingCache) get(fid uint32) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[fid]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*dirListingCacheEntry).listing, true
+}
+
+func (c *dirListingCache) put(fid uint32, listing []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeLocked(fid)
+	c.entries[fid] = c.order.PushFront(&dirListingCacheEntry{fid, listing})
+	c.size += len(listing)
+	for c.size > c.capacity && c.order.Len() > 1 {
+		c.removeLocked(c.order.Back().Value.(*dirListingCacheEntry).fid)
+	}
+}
+
+func (c *dirListingCache) remove(fid uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeLocked(fid)
+}
+
+func (c *dirListingCache) removeLocked(fid uint32) {
+	e, ok := c.entries[fid]
+	if !ok {
+		return
+	}
+	c.order.Remove(e)
+	delete(c.entries, fid)
+	c.size -= len(e.Value.(*dirListingCacheEntry).listing)
+}
+
+// bytes returns the size of all listings held.
+func (c *dirListingCache) bytes() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
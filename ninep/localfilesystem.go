@@ -0,0 +1,795 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/user"
+	p "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// qidSaveDelay is how long a local filesystem waits after assigning a qid path
+// before writing its qid file.
+const qidSaveDelay = time.Second
+
+type localFilesystem struct {
+	basePath string
+
+	qidMutex   sync.Mutex
+	qidCounter uint64
+	qidCache   *qidCache
+	qidSize    int
+	qidFile    string
+	qidDirty   bool
+	// qidTimer writes the qid file once it is due, nil when nothing waits to
+	// be written.
+	qidTimer *time.Timer
+
+	sortOrder SortOrder
+
+	preallocChunk int64
+	uncached      bool
+	noFollow      bool
+
+	// modeMap holds the DMAPPEND and DMEXCL bits of the files, which the host
+	// has no place to keep.
+	modeMutex sync.Mutex
+	modeMap   map[string]uint32
+
+	muidMutex sync.Mutex
+	muidMap   map[string]string
+
+	// openFiles counts the Files returned by Open which were not closed yet.
+	openFiles int64
+}
+
+type localFile struct {
+	fs         *localFilesystem
+	path       string
+	osFile     *os.File
+	osFileInfo os.FileInfo
+	qidPath    uint64
+	closeOnce  sync.Once
+	// reserved is the length of the file space preallocated through the
+	// file.
+	reserved int64
+}
+
+type LocalFilesystemOption func(*localFilesystem)
+
+// SortOrder is the order in which a local filesystem lists directory entries.
+type SortOrder int
+
+const (
+	SortByName SortOrder = iota
+	SortByNameDescending
+	// SortNone keeps the order in which the operating system lists entries.
+	SortNone
+)
+
+// WithSortOrder sets the order of directory entries, SortByName by default.
+func WithSortOrder(order SortOrder) LocalFilesystemOption {
+	return func(f *localFilesystem) {
+		f.sortOrder = order
+	}
+}
+
+// WithQidCacheSize bounds the number of paths whose qid paths are remembered.
+// Paths evicted from the cache get a new qid path when they are seen again.
+func WithQidCacheSize(size int) LocalFilesystemOption {
+	return func(f *localFilesystem) {
+		f.qidSize = size
+	}
+}
+
+// WithQidFile keeps the qid paths assigned to files in the given file, so they
+// survive a restart of the server. New qid paths are written qidSaveDelay after
+// they are assigned, together with the ones assigned meanwhile, and by Close,
+// which the server should call before it exits.
+func WithQidFile(path string) LocalFilesystemOption {
+	return func(f *localFilesystem) {
+		f.qidFile = path
+	}
+}
+
+// WithPreallocation makes writes extending a file reserve its space on disk up
+// to the next multiple of chunk bytes past their end, without changing its
+// length, so that large files are less fragmented and running out of space is
+// noticed early. The space left past the end of a file is released when it is
+// closed. It is only supported on Linux, and ignored by filesystems which
+// cannot preallocate.
+func WithPreallocation(chunk int64) LocalFilesystemOption {
+	return func(f *localFilesystem) {
+		f.preallocChunk = chunk
+	}
+}
+
+// WithUncachedReads advises the host to drop the data read from files from its
+// page cache, so that serving large files once, like media, does not evict
+// more useful data. It is only supported on Linux and ignored elsewhere.
+func WithUncachedReads() LocalFilesystemOption {
+	return func(f *localFilesystem) {
+		f.uncached = true
+	}
+}
+
+// WithoutFollowingSymlinks reports symbolic links as links, with DMSYMLINK set,
+// instead of as the files they point to, exposing the structure of links as it
+// is. Dangling links then exist, walks do not pass through links to
+// directories, and links cannot be opened, only read with Readlink.
+func WithoutFollowingSymlinks() LocalFilesystemOption {
+	return func(f *localFilesystem) {
+		f.noFollow = true
+	}
+}
+
+func NewLocalFilesystem(basePath string, opts ...LocalFilesystemOption) Filesystem {
+	var l localFilesystem
+	l.basePath = basePath
+	l.qidSize = DefaultQidCacheSize
+	l.modeMap = make(map[string]uint32)
+	l.muidMap = make(map[string]string)
+	for _, opt := range opts {
+		opt(&l)
+	}
+	l.qidCache = newQidCache(l.qidSize)
+	if l.qidFile != "" {
+		l.loadQids()
+	}
+	return &l
+}
+
+func (f *localFilesystem) Open(path string, mode uint8) (File, error) {
+	fullPath := f.normalizePath(path)
+	fileInfo, err := f.stat(path)
+	if err != nil {
+		return nil, osError(err)
+	}
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		return nil, ErrNotSupported
+	}
+	if fileInfo.IsDir() {
+		return f.newFile(path, nil, fileInfo), nil
+	}
+	modeToFlag := map[uint8]int{OREAD: os.O_RDONLY, OWRITE: os.O_WRONLY, ORDWR: os.O_RDWR, OEXEC: os.O_RDONLY}
+	flag := modeToFlag[mode&3]
+	if mode&OTRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	// os.OpenFile always sets O_CLOEXEC, so client files never leak into
+	// processes started by the server.
+	file, err := os.OpenFile(fullPath, flag, os.ModePerm)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrIOError
+	}
+	if mode&OTRUNC != 0 {
+		// The qid of the file must tell it was truncated.
+		fileInfo, err = file.Stat()
+		if err != nil {
+			_ = file.Close()
+			log.Println(err)
+			return nil, ErrIOError
+		}
+	}
+	return f.newFile(path, file, fileInfo), nil
+}
+
+func (f *localFilesystem) CreateDir(path string, perm uint32) error {
+	fullPath := f.normalizePath(path)
+	if _, err := f.stat(path); err == nil {
+		return ErrAlreadyExists
+	}
+	err := os.Mkdir(fullPath, os.FileMode(perm)&os.ModePerm)
+	if err != nil {
+		return osError(err)
+	}
+	return nil
+}
+
+func (f *localFilesystem) CreateFile(path string, perm uint32) error {
+	fullPath := f.normalizePath(path)
+	if _, err := f.stat(path); err == nil {
+		return ErrAlreadyExists
+	}
+	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.FileMode(perm)&os.ModePerm)
+	if err != nil {
+		return osError(err)
+	}
+	_ = file.Close()
+	f.setExtraMode(path, perm)
+	return nil
+}
+
+func (f *localFilesystem) ReadDir(path string) ([]Stat, error) {
+	stats, _, err := f.readDir(path, -1)
+	return stats, err
+}
+
+// ReadDirLimit reads no more than max entries from the host. When the
+// directory has more, they are the ones the host happens to list first, which
+// are then sorted in the sort order of the filesystem, not the first max of
+// the sorted listing.
+func (f *localFilesystem) ReadDirLimit(path string, max int) ([]Stat, bool, error) {
+	return f.readDir(path, max)
+}
+
+// readDir lists at most max entries of the directory at path, or all of them
+// if max is negative, and reports whether there were more.
+func (f *localFilesystem) readDir(path string, max int) ([]Stat, bool, error) {
+	dir, err := os.Open(f.normalizePath(path))
+	if err != nil {
+		log.Println(err)
+		return nil, false, ErrIOError
+	}
+	n := -1
+	if max >= 0 {
+		// One more tells whether the directory has more.
+		n = max + 1
+	}
+	entries, err := dir.ReadDir(n)
+	_ = dir.Close()
+	if err != nil && !(n > 0 && err == io.EOF) {
+		log.Println(err)
+		return nil, false, ErrIOError
+	}
+	more := max >= 0 && len(entries) > max
+	if more {
+		entries = entries[:max]
+	}
+	switch f.sortOrder {
+	case SortByName:
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	case SortByNameDescending:
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() > entries[j].Name() })
+	}
+	stats := make([]Stat, len(entries))
+	for i, entry := range entries {
+		fileInfo, err := entry.Info()
+		if err != nil {
+			log.Println(err)
+			return nil, false, ErrIOError
+		}
+		if fileInfo.Mode()&os.ModeSymlink != 0 && !f.noFollow {
+			// Dangling links are listed as they are.
+			if target, err := os.Stat(f.normalizePath(p.Join(path, fileInfo.Name()))); err == nil {
+				fileInfo = renamedFileInfo{target, fileInfo.Name()}
+			}
+		}
+		entryPath := p.Join(path, fileInfo.Name())
+		stats[i] = f.makeStat(entryPath, f.qidPath(entryPath), fileInfo)
+	}
+	return stats, more, nil
+}
+
+func (f *localFilesystem) Remove(path string) error {
+	fullPath := f.normalizePath(path)
+	err := os.Remove(fullPath)
+	if err != nil {
+		if strings.Contains(err.Error(), "not empty") {
+			return ErrDirectoryNotEmpty
+		}
+		log.Println(err)
+		return ErrIOError
+	}
+	f.setExtraMode(path, 0)
+	f.SetMuid(path, "")
+	return err
+}
+
+func (f *localFilesystem) Readlink(path string) (string, error) {
+	target, err := os.Readlink(f.normalizePath(path))
+	if err != nil {
+		return "", osError(err)
+	}
+	return target, nil
+}
+
+func (f *localFilesystem) Stat(path string) (Stat, error) {
+	fileInfo, err := f.stat(path)
+	if err != nil {
+		return Stat{}, osError(err)
+	}
+	return f.makeStat(path, f.qidPath(path), fileInfo), nil
+}
+
+// stat returns the information about the file at path, or about the link
+// itself when not following symbolic links.
+func (f *localFilesystem) stat(path string) (os.FileInfo, error) {
+	if !f.noFollow {
+		return os.Stat(f.normalizePath(path))
+	}
+	// The host resolves links in the leading components of a path, so they
+	// are checked one by one. The base path is always followed, it may be a
+	// link itself.
+	names := strings.Split(p.Clean("/"+path), "/")
+	if names[1] == "" {
+		return os.Stat(f.basePath)
+	}
+	dir := f.basePath
+	for _, name := range names[1 : len(names)-1] {
+		dir = p.Join(dir, name)
+		fileInfo, err := os.Lstat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !fileInfo.IsDir() {
+			return nil, &os.PathError{Op: "lstat", Path: dir, Err: syscall.ENOTDIR}
+		}
+	}
+	return os.Lstat(f.normalizePath(path))
+}
+
+// renamedFileInfo is the information about the target of a symbolic link under
+// the name of the link.
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i renamedFileInfo) Name() string {
+	return i.name
+}
+
+func (f *localFilesystem) Wstat(path string, stat Stat) error {
+	if stat.Mode != ^uint32(0) {
+		err := os.Chmod(f.normalizePath(path), os.FileMode(stat.Mode)&os.ModePerm)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return ErrDoesNotExist
+			}
+			log.Println(err)
+			return ErrIOError
+		}
+		f.setExtraMode(path, stat.Mode)
+	}
+	if stat.Uid != "" || stat.Gid != "" {
+		err := chown(f.normalizePath(path), stat.Uid, stat.Gid)
+		if err != nil {
+			return err
+		}
+	}
+	if stat.Length != ^uint64(0) {
+		fileInfo, err := os.Stat(f.normalizePath(path))
+		if err != nil {
+			return osError(err)
+		}
+		// The length of a directory is always zero and may only be set to zero.
+		if fileInfo.IsDir() {
+			if stat.Length != 0 {
+				return ErrIOError
+			}
+			return nil
+		}
+		if stat.Length > math.MaxInt64 {
+			return ErrIOError
+		}
+		err = os.Truncate(f.normalizePath(path), int64(stat.Length))
+		if err != nil {
+			return osError(err)
+		}
+	}
+	if stat.Name != "" {
+		return f.rename(path, stat.Name)
+	}
+	return nil
+}
+
+// rename gives the file at path the new name within its directory, keeping
+// its qid path, append-only and exclusive bits and muid, and those of the files below it.
+// Renames are not emulated by copying, so one the host cannot do, such as to
+// another device, fails with ErrCrossDevice.
+func (f *localFilesystem) rename(path string, name string) error {
+	path = p.Clean("/" + path)
+	newPath := p.Join(p.Dir(path), name)
+	// The host would replace the file of that name.
+	_, err := os.Lstat(f.normalizePath(newPath))
+	if err == nil {
+		return ErrAlreadyExists
+	}
+	err = os.Rename(f.normalizePath(path), f.normalizePath(newPath))
+	if err != nil {
+		return osError(err)
+	}
+	f.qidMutex.Lock()
+	if f.qidCache.rename(path, newPath) {
+		f.qidChangedLocked()
+	}
+	f.qidMutex.Unlock()
+	f.modeMutex.Lock()
+	renamePaths(f.modeMap, path, newPath)
+	f.modeMutex.Unlock()
+	f.muidMutex.Lock()
+	renamePaths(f.muidMap, path, newPath)
+	f.muidMutex.Unlock()
+	return nil
+}
+
+// chown gives the file at fullPath to the user and group with the given names,
+// leaving the owner or the group as it is when its name is empty or the "?"
+// Stat reports, so that stats read from the server can be written back. Only
+// privileged processes may give files away.
+func chown(fullPath string, uname string, gname string) error {
+	uid, gid := -1, -1
+	if uname != "" && uname != "?" {
+		u, err := user.Lookup(uname)
+		if err != nil {
+			return ErrUnknownUser
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return ErrNotSupported
+		}
+	}
+	if gname != "" && gname != "?" {
+		g, err := user.LookupGroup(gname)
+		if err != nil {
+			return ErrUnknownUser
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return ErrNotSupported
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	err := os.Chown(fullPath, uid, gid)
+	if errors.Is(err, syscall.EPERM) {
+		return ErrOperationNotPermitted
+	}
+	if err != nil {
+		return osError(err)
+	}
+	return nil
+}
+
+// osError translates an error of the os package to the errors of this package.
+func osError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ErrDoesNotExist
+	case errors.Is(err, os.ErrExist):
+		return ErrAlreadyExists
+	// A file used as a directory component of a path.
+	case errors.Is(err, syscall.ENOTDIR):
+		return ErrNotDirectory
+	// The server lacks the rights to a file, e.g. to the base path.
+	case errors.Is(err, syscall.EACCES):
+		return ErrPermissionDenied
+	}
+	if err := errnoError(err); err != nil {
+		return err
+	}
+	log.Println(err)
+	return ErrIOError
+}
+
+func (f *localFilesystem) newFile(path string, osFile *os.File, fileInfo os.FileInfo) *localFile {
+	atomic.AddInt64(&f.openFiles, 1)
+	return &localFile{fs: f, path: path, osFile: osFile, osFileInfo: fileInfo, qidPath: f.qidPath(path)}
+}
+
+// normalizePath returns the path on the host of path, which is always inside
+// basePath, even for relative paths with leading "..".
+func (f *localFilesystem) normalizePath(path string) string {
+	return p.Join(f.basePath, p.Clean("/"+path))
+}
+
+func (f *localFilesystem) isAppendOnly(path string) bool {
+	return f.extraMode(path)&DMAPPEND != 0
+}
+
+// extraMode returns the DMAPPEND and DMEXCL bits of path.
+func (f *localFilesystem) extraMode(path string) uint32 {
+	f.modeMutex.Lock()
+	defer f.modeMutex.Unlock()
+	return f.modeMap[path]
+}
+
+// setExtraMode remembers the DMAPPEND and DMEXCL bits of mode for path.
+func (f *localFilesystem) setExtraMode(path string, mode uint32) {
+	f.modeMutex.Lock()
+	defer f.modeMutex.Unlock()
+	if mode&(DMAPPEND|DMEXCL) != 0 {
+		f.modeMap[path] = mode & (DMAPPEND | DMEXCL)
+	} else {
+		delete(f.modeMap, path)
+	}
+}
+
+// SetMuid remembers uname as the last modifier of path while the server runs,
+// the host filesystem has no place to keep it.
+func (f *localFilesystem) SetMuid(path string, uname string) {
+	f.muidMutex.Lock()
+	defer f.muidMutex.Unlock()
+	if uname != "" {
+		f.muidMap[path] = uname
+	} else {
+		delete(f.muidMap, path)
+	}
+}
+
+func (f *localFilesystem) muid(path string) string {
+	f.muidMutex.Lock()
+	defer f.muidMutex.Unlock()
+	return f.muidMap[path]
+}
+
+func (f *localFilesystem) fileMode(path string, fileInfo os.FileInfo) uint32 {
+	mode := uint32(fileInfo.Mode().Perm())
+	if fileInfo.IsDir() {
+		mode |= DMDIR
+	} else if fileInfo.Mode()&os.ModeSymlink != 0 {
+		mode |= DMSYMLINK
+	} else {
+		mode |= f.extraMode(path)
+	}
+	return mode
+}
+
+func (f *localFilesystem) makeStat(path string, qidPath uint64, fileInfo os.FileInfo) Stat {
+	mode := f.fileMode(path, fileInfo)
+	qid := Qid{qidType(mode), qidVersion(fileInfo), qidPath}
+	var length uint64
+	if !fileInfo.IsDir() {
+		length = uint64(fileInfo.Size())
+	}
+	return Stat{
+		Dev:    fileDev(fileInfo),
+		Qid:    qid,
+		Mode:   mode,
+		Length: length,
+		Name:   fileInfo.Name(),
+		Uid:    "?",
+		Gid:    "?",
+		Muid:   f.muid(path),
+		Atime:  uint32(fileInfo.ModTime().Unix()),
+		Mtime:  uint32(fileInfo.ModTime().Unix()),
+	}
+}
+
+// qidVersion derives the version of a file from its modification time, to the
+// precision the host keeps it, and its length, so that the version changes
+// with changes made within the same second too, like truncating the file.
+func qidVersion(fileInfo os.FileInfo) uint32 {
+	h := fnv.New32a()
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(fileInfo.ModTime().UnixNano()))
+	binary.LittleEndian.PutUint64(b[8:], uint64(fileInfo.Size()))
+	h.Write(b[:])
+	return h.Sum32()
+}
+
+func (f *localFilesystem) qidPath(path string) uint64 {
+	f.qidMutex.Lock()
+	defer f.qidMutex.Unlock()
+	qidPath, ok := f.qidCache.get(path)
+	if ok {
+		return qidPath
+	}
+	qidPath = f.qidCounter
+	f.qidCache.put(path, qidPath)
+	f.qidCounter += 1
+	f.qidChangedLocked()
+	return qidPath
+}
+
+// qidChangedLocked records that the qid file is out of date and schedules
+// writing it. f.qidMutex must be held.
+func (f *localFilesystem) qidChangedLocked() {
+	f.qidDirty = true
+	if f.qidFile == "" || f.qidTimer != nil {
+		return
+	}
+	f.qidTimer = time.AfterFunc(qidSaveDelay, func() {
+		err := f.saveQids()
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// Close writes the qid paths which were not written to the qid file yet. The
+// filesystem remains usable.
+func (f *localFilesystem) Close() error {
+	f.qidMutex.Lock()
+	if f.qidTimer != nil {
+		f.qidTimer.Stop()
+	}
+	f.qidMutex.Unlock()
+	return f.saveQids()
+}
+
+type qidFileContent struct {
+	Counter uint64
+	Paths   map[string]uint64
+}
+
+// loadQids restores the qid map from the qid file, dropping paths which no
+// longer exist.
+func (f *localFilesystem) loadQids() {
+	b, err := os.ReadFile(f.qidFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+		return
+	}
+	var content qidFileContent
+	err = json.Unmarshal(b, &content)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	f.qidCounter = content.Counter
+	for path, qidPath := range content.Paths {
+		if _, err := os.Lstat(f.normalizePath(path)); err == nil {
+			f.qidCache.put(path, qidPath)
+		}
+	}
+	f.qidDirty = f.qidCache.len() != len(content.Paths)
+}
+
+func (f *localFilesystem) saveQids() error {
+	if f.qidFile == "" {
+		return nil
+	}
+	f.qidMutex.Lock()
+	defer f.qidMutex.Unlock()
+	f.qidTimer = nil
+	if !f.qidDirty {
+		return nil
+	}
+	paths := make(map[string]uint64)
+	for _, entry := range f.qidCache.snapshot() {
+		paths[entry.path] = entry.qidPath
+	}
+	b, err := json.Marshal(qidFileContent{f.qidCounter, paths})
+	if err != nil {
+		return err
+	}
+	tmpFile := f.qidFile + ".tmp"
+	err = os.WriteFile(tmpFile, b, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, f.qidFile)
+	}
+	if err != nil {
+		return err
+	}
+	f.qidDirty = false
+	return nil
+}
+
+func (f *localFile) Qid() Qid {
+	return Qid{qidType(f.fs.fileMode(f.path, f.osFileInfo)), qidVersion(f.osFileInfo), f.qidPath}
+}
+
+func (f *localFile) IsDir() bool {
+	return f.osFileInfo.IsDir()
+}
+
+func (f *localFile) Stat() (Stat, error) {
+	fileInfo := f.osFileInfo
+	if f.osFile != nil {
+		// The length may have changed since the file was opened, even by a
+		// write which failed halfway.
+		var err error
+		fileInfo, err = f.osFile.Stat()
+		if err != nil {
+			log.Println(err)
+			return Stat{}, ErrIOError
+		}
+	}
+	return f.fs.makeStat(f.path, f.qidPath, fileInfo), nil
+}
+
+func (f *localFile) Read(offset uint64, count uint32) ([]byte, error) {
+	if offset > math.MaxInt64 {
+		return []byte{}, nil
+	}
+	buffer := make([]byte, count)
+	n, err := f.osFile.ReadAt(buffer, int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Println(err)
+		return nil, ErrIOError
+	}
+	if f.fs.uncached && n > 0 {
+		// Only advice, which the host may not follow.
+		_ = dropCache(f.osFile, int64(offset), int64(n))
+	}
+	return buffer[:n], nil
+}
+
+// ReadAt makes localFile a ReaderAtFile, reading straight from the file on the
+// host.
+func (f *localFile) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := f.osFile.ReadAt(p, offset)
+	if f.fs.uncached && n > 0 {
+		_ = dropCache(f.osFile, offset, int64(n))
+	}
+	return n, err
+}
+
+func (f *localFile) Write(offset uint64, data []byte) error {
+	if f.fs.isAppendOnly(f.path) {
+		fileInfo, err := f.osFile.Stat()
+		if err != nil {
+			log.Println(err)
+			return ErrIOError
+		}
+		offset = uint64(fileInfo.Size())
+	}
+	f.preallocate(int64(offset) + int64(len(data)))
+	n, err := f.osFile.WriteAt(data, int64(offset))
+	if err != nil {
+		err = osError(err)
+		if n > 0 {
+			return &PartialWriteError{n, err}
+		}
+		return err
+	}
+	return nil
+}
+
+// preallocate reserves the space of the file up to end rounded up to the
+// preallocation chunk, if it was not reserved yet. Failing to is left to the
+// write to report.
+func (f *localFile) preallocate(end int64) {
+	chunk := f.fs.preallocChunk
+	reserved := atomic.LoadInt64(&f.reserved)
+	if chunk <= 0 || end <= reserved {
+		return
+	}
+	end = (end + chunk - 1) / chunk * chunk
+	if fallocate(f.osFile, reserved, end-reserved) == nil {
+		atomic.StoreInt64(&f.reserved, end)
+	}
+}
+
+// releasePreallocation frees the space reserved past the end of the file.
+func (f *localFile) releasePreallocation() {
+	reserved := atomic.LoadInt64(&f.reserved)
+	if reserved == 0 {
+		return
+	}
+	fileInfo, err := f.osFile.Stat()
+	if err != nil || fileInfo.Size() >= reserved {
+		return
+	}
+	_ = trimFile(f.osFile)
+}
+
+func (f *localFile) Sync() error {
+	if f.osFile == nil {
+		return nil
+	}
+	err := f.osFile.Sync()
+	if err != nil {
+		// Data written back only now may not fit.
+		return osError(err)
+	}
+	return nil
+}
+
+func (f *localFile) Close() {
+	f.closeOnce.Do(func() {
+		if f.osFile != nil {
+			f.releasePreallocation()
+			_ = f.osFile.Close()
+		}
+		atomic.AddInt64(&f.fs.openFiles, -1)
+	})
+}
@@ -0,0 +1,33 @@
+package ninep
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func fallocate(file *os.File, offset int64, length int64) error {
+	return unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
+
+// trimFile frees the space allocated to file past its end. Holes cannot be
+// punched there on every filesystem, but truncating the file to its length
+// frees it. The times the truncation sets are put back.
+func trimFile(file *os.File) error {
+	var stat unix.Stat_t
+	err := unix.Fstat(int(file.Fd()), &stat)
+	if err != nil {
+		return err
+	}
+	err = unix.Ftruncate(int(file.Fd()), stat.Size)
+	if err != nil {
+		return err
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, file.Name(), []unix.Timespec{stat.Atim, stat.Mtim}, 0)
+}
+
+// dropCache advises the kernel that the given range of file will not be read
+// again, so its pages may be dropped from the page cache.
+func dropCache(file *os.File, offset int64, length int64) error {
+	return unix.Fadvise(int(file.Fd()), offset, length, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,89 @@
+package ninep
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocation(t *testing.T) {
+	const chunk = 1 << 20
+	dir := t.TempDir()
+	fs := NewLocalFilesystem(dir, WithPreallocation(chunk))
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open("/file", OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Write(0, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Size() != 4 {
+		t.Errorf("got size %d, want 4", fileInfo.Size())
+	}
+	if allocated := fileInfo.Sys().(*syscall.Stat_t).Blocks * 512; allocated < chunk {
+		t.Errorf("got %d bytes allocated, want at least %d", allocated, chunk)
+	}
+	file.Close()
+	mtime := fileInfo.ModTime()
+	fileInfo, err = os.Stat(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileInfo.ModTime().Equal(mtime) || fileInfo.Size() != 4 {
+		t.Errorf("got mtime %v and size %d after closing, want %v and 4", fileInfo.ModTime(), fileInfo.Size(), mtime)
+	}
+	if allocated := fileInfo.Sys().(*syscall.Stat_t).Blocks * 512; allocated >= chunk {
+		t.Errorf("got %d bytes allocated after closing, want less than %d", allocated, chunk)
+	}
+}
+
+func TestUncachedReads(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewLocalFilesystem(dir, WithUncachedReads())
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open("/file", OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := file.Read(0, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Errorf("got '%s', want 'data'", data)
+	}
+	if err := dropCache(file.(*localFile).osFile, 0, 4); err != nil {
+		t.Errorf("got %v, want the advice to be taken", err)
+	}
+}
+
+func TestWriteFullDevice(t *testing.T) {
+	// Every write to /dev/full fails with ENOSPC.
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip(err)
+	}
+	c := newTestClient(t, NewLocalFilesystem("/dev"))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"full"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OWRITE}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	err := c.rpc(&Twrite{Tag: 1, Fid: 1, Offset: 0, Data: []byte("data")}, &Rwrite{})
+	if err != rerror(ENoSpaceStr) {
+		t.Errorf("got %v, want %v", err, rerror(ENoSpaceStr))
+	}
+}
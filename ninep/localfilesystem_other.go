@@ -0,0 +1,22 @@
+//go:build !linux
+
+package ninep
+
+import (
+	"errors"
+	"os"
+)
+
+var errNotSupportedHere = errors.New("not supported on this system")
+
+func fallocate(file *os.File, offset int64, length int64) error {
+	return errNotSupportedHere
+}
+
+func trimFile(file *os.File) error {
+	return errNotSupportedHere
+}
+
+func dropCache(file *os.File, offset int64, length int64) error {
+	return errNotSupportedHere
+}
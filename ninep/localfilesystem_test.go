@@ -0,0 +1,569 @@
+package ninep
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestAppendOnlyWstat(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	err := fs.CreateFile("/log", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open("/log", ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Write(0, []byte("hello"))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Wstat("/log", Stat{Mode: DMAPPEND | 0644, Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := fs.Stat("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode&DMAPPEND == 0 {
+		t.Errorf("got mode %#o, want DMAPPEND set", stat.Mode)
+	}
+
+	file, err = fs.Open("/log", ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = file.Write(0, []byte(" world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := file.Read(0, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("got '%s', want '%s'", data, "hello world")
+	}
+}
+
+func TestAppendOnlyCreate(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	err := fs.CreateFile("/log", DMAPPEND|0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := fs.Stat("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode&DMAPPEND == 0 {
+		t.Errorf("got mode %#o, want DMAPPEND set", stat.Mode)
+	}
+}
+
+func TestAppendOnlyRenameDir(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateDir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("/dir/log", DMAPPEND|0644); err != nil {
+		t.Fatal(err)
+	}
+	fs.(MuidSetter).SetMuid("/dir/log", "glenda")
+	if err := fs.Wstat("/dir", Stat{Name: "renamed", Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)}); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := fs.Stat("/renamed/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode&DMAPPEND == 0 {
+		t.Errorf("got mode %#o, want DMAPPEND set", stat.Mode)
+	}
+	if stat.Muid != "glenda" {
+		t.Errorf("got muid '%s', want '%s'", stat.Muid, "glenda")
+	}
+}
+
+func TestQidFile(t *testing.T) {
+	basePath := t.TempDir()
+	qidFile := filepath.Join(t.TempDir(), "qids.json")
+	fs := NewLocalFilesystem(basePath, WithQidFile(qidFile))
+	for _, name := range []string{"/a", "/b", "/c"} {
+		if err := fs.CreateFile(name, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qids := make(map[string]Qid)
+	for _, stat := range stats {
+		qids["/"+stat.Name] = stat.Qid
+	}
+	// The qid paths are written together later rather than as they are
+	// assigned.
+	if _, err := os.Stat(qidFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want %v", err, os.ErrNotExist)
+	}
+	if err := fs.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(basePath, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = NewLocalFilesystem(basePath, WithQidFile(qidFile))
+	for _, name := range []string{"/a", "/b"} {
+		stat, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Qid.Path != qids[name].Path {
+			t.Errorf("got qid path %d for %s, want %d", stat.Qid.Path, name, qids[name].Path)
+		}
+	}
+	if _, ok := fs.(*localFilesystem).qidCache.get("/c"); ok {
+		t.Error("qid of a removed path was restored")
+	}
+	if err := fs.CreateFile("/d", 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := fs.Stat("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, qid := range qids {
+		if stat.Qid.Path == qid.Path {
+			t.Errorf("new file got qid path %d already used by %s", stat.Qid.Path, name)
+		}
+	}
+	if err := fs.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRemoveAndRead(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		t.Run(name, func(t *testing.T) {
+			content := []byte("some file content")
+			for i := 0; i < 20; i++ {
+				if err := fs.CreateFile("/file", 0644); err != nil {
+					t.Fatal(err)
+				}
+				file, err := fs.Open("/file", ORDWR)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := file.Write(0, content); err != nil {
+					t.Fatal(err)
+				}
+				var wg sync.WaitGroup
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						data, err := file.Read(0, 64)
+						if err != nil {
+							if err != ErrIOError && err != ErrDoesNotExist {
+								t.Errorf("got unexpected error %v", err)
+							}
+							continue
+						}
+						if string(data) != string(content) {
+							t.Errorf("got '%s', want '%s'", data, content)
+						}
+						if _, err := file.Stat(); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					if err := fs.Remove("/file"); err != nil {
+						t.Error(err)
+					}
+					_, _ = fs.Stat("/file")
+				}()
+				wg.Wait()
+				file.Close()
+			}
+		})
+	}
+}
+
+func TestQidType(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		if err := fs.CreateDir("/dir", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile("/log", DMAPPEND|0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile("/lock", DMEXCL|0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]uint8{"dir": QTDIR, "log": QTAPPEND, "lock": QTEXCL, "file": QTFILE}
+		stats, err := fs.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stat := range stats {
+			if stat.Qid.Ftype != want[stat.Name] {
+				t.Errorf("%s: got qid type %#x for %s, want %#x", name, stat.Qid.Ftype, stat.Name, want[stat.Name])
+			}
+			file, err := fs.Open("/"+stat.Name, OREAD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.Qid().Ftype != want[stat.Name] {
+				t.Errorf("%s: got open qid type %#x for %s, want %#x", name, file.Qid().Ftype, stat.Name, want[stat.Name])
+			}
+			file.Close()
+		}
+	}
+}
+
+func TestQidCacheEviction(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir(), WithQidCacheSize(4))
+	if err := fs.CreateFile("/open", 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open("/open", OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	openQid := file.Qid()
+
+	firstStats := make(map[string]Stat)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("/file%d", i)
+		if err := fs.CreateFile(name, 0644); err != nil {
+			t.Fatal(err)
+		}
+		stat, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		firstStats[name] = stat
+		if _, err := fs.Stat("/file0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := fs.(*localFilesystem).qidCache
+	if cache.len() != 4 {
+		t.Errorf("got %d cached qids, want 4", cache.len())
+	}
+	if _, ok := cache.get("/file1"); ok {
+		t.Error("least recently used /file1 was not evicted")
+	}
+	stat, err := fs.Stat("/file0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Qid.Path != firstStats["/file0"].Qid.Path {
+		t.Errorf("got qid path %d for recently used /file0, want %d", stat.Qid.Path, firstStats["/file0"].Qid.Path)
+	}
+	if file.Qid() != openQid {
+		t.Errorf("got qid %+v for the open file, want %+v", file.Qid(), openQid)
+	}
+}
+
+func TestOpenMissingComponent(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path string
+		want error
+	}{
+		{"/missing", ErrDoesNotExist},
+		{"/missing/file", ErrDoesNotExist},
+		{"/file/child", ErrNotDirectory},
+	} {
+		_, err := fs.Open(tt.path, OREAD)
+		if err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.path, err, tt.want)
+		}
+	}
+}
+
+func TestOpenMode(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		mode     uint8
+		canRead  bool
+		canWrite bool
+	}{
+		{"OREAD", OREAD, true, false},
+		{"OWRITE", OWRITE, false, true},
+		{"ORDWR", ORDWR, true, true},
+		{"OEXEC", OEXEC, true, false},
+		{"OWRITE|OTRUNC", OWRITE | OTRUNC, false, true},
+	} {
+		file, err := fs.Open("/file", tc.mode)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		_, err = file.Read(0, 1)
+		if canRead := err == nil; canRead != tc.canRead {
+			t.Errorf("%s: got read error %v, want reading allowed %v", tc.name, err, tc.canRead)
+		}
+		err = file.Write(0, []byte("a"))
+		if canWrite := err == nil; canWrite != tc.canWrite {
+			t.Errorf("%s: got write error %v, want writing allowed %v", tc.name, err, tc.canWrite)
+		}
+		file.Close()
+	}
+}
+
+func TestOpenFileStatLength(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open("/file", ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Write(0, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Length != 5 {
+		t.Errorf("got length %d, want %d", stat.Length, 5)
+	}
+}
+
+func TestSortOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b", "c", "a"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := func(order SortOrder) string {
+		stats, err := NewLocalFilesystem(dir, WithSortOrder(order)).ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names string
+		for _, stat := range stats {
+			names += stat.Name
+		}
+		return names
+	}
+	if got := names(SortByName); got != "abc" {
+		t.Errorf("got %s, want %s", got, "abc")
+	}
+	if got := names(SortByNameDescending); got != "cba" {
+		t.Errorf("got %s, want %s", got, "cba")
+	}
+	if got := names(SortNone); len(got) != 3 || !strings.ContainsRune(got, 'a') || !strings.ContainsRune(got, 'b') || !strings.ContainsRune(got, 'c') {
+		t.Errorf("got %s, want a permutation of %s", got, "abc")
+	}
+}
+
+func TestNormalizePathRoot(t *testing.T) {
+	fs := NewLocalFilesystem("/srv/9p").(*localFilesystem)
+	for _, path := range []string{"", ".", "/", "/..", "/../..", "..", "../.."} {
+		if got := fs.normalizePath(path); got != "/srv/9p" {
+			t.Errorf("%q: got %s, want %s", path, got, "/srv/9p")
+		}
+	}
+	if got := fs.normalizePath("../../etc/passwd"); got != "/srv/9p/etc/passwd" {
+		t.Errorf("got %s, want %s", got, "/srv/9p/etc/passwd")
+	}
+}
+
+func TestCreateMissingParent(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path string
+		want error
+	}{
+		{"/missing/child", ErrDoesNotExist},
+		{"/file/child", ErrNotDirectory},
+		{"/file", ErrAlreadyExists},
+	} {
+		if err := fs.CreateDir(tt.path, 0755); err != tt.want {
+			t.Errorf("CreateDir %s: got %v, want %v", tt.path, err, tt.want)
+		}
+		if err := fs.CreateFile(tt.path, 0644); err != tt.want {
+			t.Errorf("CreateFile %s: got %v, want %v", tt.path, err, tt.want)
+		}
+	}
+}
+
+func TestOverwriteWithoutTruncate(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	write := func(mode uint8, data string) string {
+		file, err := fs.Open("/file", mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := file.Write(0, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		content, err := file.Read(0, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	write(ORDWR, "hello world")
+	if got := write(ORDWR, "HELLO"); got != "HELLO world" {
+		t.Errorf("got '%s', want '%s'", got, "HELLO world")
+	}
+	if got := write(ORDWR|OTRUNC, "HELLO"); got != "HELLO" {
+		t.Errorf("got '%s', want '%s'", got, "HELLO")
+	}
+}
+
+func TestReadAcrossEOF(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewLocalFilesystem(dir).Open("/file", OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, tt := range []struct {
+		offset uint64
+		want   string
+	}{
+		{3, "lo"},
+		{5, ""},
+		{100, ""},
+	} {
+		data, err := file.Read(tt.offset, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("offset %d: got %q, want %q", tt.offset, data, tt.want)
+		}
+	}
+}
+
+func TestPermissionDeniedError(t *testing.T) {
+	err := osError(&os.PathError{Op: "stat", Path: "/root/dir", Err: syscall.EACCES})
+	if err != ErrPermissionDenied {
+		t.Errorf("got %v, want %v", err, ErrPermissionDenied)
+	}
+}
+
+func TestStatGrowingOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log")
+	if err := os.WriteFile(path, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, NewLocalFilesystem(dir))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"log"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"two\n", "three\n"} {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteString(line)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rstat Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+			t.Fatal(err)
+		}
+		if rstat.Stat.Length != uint64(fileInfo.Size()) {
+			t.Errorf("got length %d, want %d", rstat.Stat.Length, fileInfo.Size())
+		}
+	}
+}
+
+func TestReadDirLimit(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	reader := fs.(LimitedDirReader)
+	if err := fs.CreateDir("/empty", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := fs.CreateFile(fmt.Sprintf("/file%d", i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		path string
+		max  int
+		want int
+		more bool
+	}{
+		{"/", 3, 3, true},
+		{"/", 5, 5, true},
+		{"/", 6, 6, false},
+		{"/", 0, 0, true},
+		{"/empty", 3, 0, false},
+	} {
+		stats, more, err := reader.ReadDirLimit(tc.path, tc.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != tc.want || more != tc.more {
+			t.Errorf("%s limited to %d: got %d entries and %v, want %d and %v", tc.path, tc.max, len(stats), more, tc.want, tc.more)
+		}
+		// Any of the entries may be left out, those kept are sorted.
+		for i, stat := range stats {
+			if _, err := fs.Stat(tc.path + "/" + stat.Name); err != nil {
+				t.Errorf("%s limited to %d: listed %s: %v", tc.path, tc.max, stat.Name, err)
+			}
+			if i > 0 && stats[i-1].Name >= stat.Name {
+				t.Errorf("%s limited to %d: got %s after %s", tc.path, tc.max, stat.Name, stats[i-1].Name)
+			}
+		}
+	}
+}
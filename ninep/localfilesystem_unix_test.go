@@ -0,0 +1,311 @@
+//go:build unix
+
+package ninep
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestOpenSetsCloseOnExec(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []uint8{OREAD, ORDWR, ORDWR | OTRUNC} {
+		file, err := fs.Open("/file", mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd := file.(*localFile).osFile.Fd()
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFD, 0)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		if flags&syscall.FD_CLOEXEC == 0 {
+			t.Errorf("got fd flags %#x for mode %#x, want FD_CLOEXEC", flags, mode)
+		}
+		file.Close()
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink("loop", filepath.Join(dir, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b", filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewLocalFilesystem(dir)
+	for _, path := range []string{"/loop", "/a", "/b/file"} {
+		if _, err := fs.Open(path, OREAD); err != ErrSymlinkLoop {
+			t.Errorf("%s: got %v, want %v", path, err, ErrSymlinkLoop)
+		}
+	}
+
+	c := newTestClient(t, fs)
+	c.attach(0)
+	err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"loop"}}, &Rwalk{})
+	if err != rerror(ESymlinkLoopStr) {
+		t.Errorf("got %v, want %v", err, ESymlinkLoopStr)
+	}
+}
+
+func TestReadlink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink("../target", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewLocalFilesystem(dir).(ReadlinkFilesystem)
+	target, err := fs.Readlink("/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../target" {
+		t.Errorf("got %s, want %s", target, "../target")
+	}
+	if _, err := fs.Readlink("/missing"); err != ErrDoesNotExist {
+		t.Errorf("got %v, want %v", err, ErrDoesNotExist)
+	}
+	// Wrappers read links of the filesystems which have them.
+	wrapped := NewCaseInsensitiveFilesystem(NewLocalFilesystem(dir)).(ReadlinkFilesystem)
+	if target, err := wrapped.Readlink("/LINK"); err != nil || target != "../target" {
+		t.Errorf("got %s and %v, want %s", target, err, "../target")
+	}
+	wrapped = NewCaseInsensitiveFilesystem(NewMemFilesystem()).(ReadlinkFilesystem)
+	if _, err := wrapped.Readlink("/"); err != ErrNotSupported {
+		t.Errorf("got %v, want %v", err, ErrNotSupported)
+	}
+}
+
+func TestFollowingSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "target"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "target", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		opts []LocalFilesystemOption
+		// mode is the type of /link, in the stat of the link and in the
+		// listing of the root.
+		mode uint32
+		// walkErr is the error of walking through the link.
+		walkErr error
+	}{
+		{"follow", nil, DMDIR, nil},
+		{"no follow", []LocalFilesystemOption{WithoutFollowingSymlinks()}, DMSYMLINK, ErrNotDirectory},
+	} {
+		fs := NewLocalFilesystem(dir, test.opts...)
+		stat, err := fs.Stat("/link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stat.Mode & (DMDIR | DMSYMLINK); got != test.mode {
+			t.Errorf("%s: got mode %#x, want %#x", test.name, got, test.mode)
+		}
+		if got, want := stat.Qid.Ftype, qidType(test.mode); got != want {
+			t.Errorf("%s: got qid type %#x, want %#x", test.name, got, want)
+		}
+		stats, err := fs.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != 2 || stats[0].Name != "link" || stats[0].Mode&(DMDIR|DMSYMLINK) != test.mode {
+			t.Errorf("%s: got %+v, want link with mode %#x first", test.name, stats, test.mode)
+		}
+		if _, err := fs.Stat("/link/file"); err != test.walkErr {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.walkErr)
+		}
+	}
+}
+
+func TestNotFollowingDanglingSymlink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink("missing", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLocalFilesystem(dir).Stat("/link"); err != ErrDoesNotExist {
+		t.Errorf("got %v, want %v", err, ErrDoesNotExist)
+	}
+	fs := NewLocalFilesystem(dir, WithoutFollowingSymlinks())
+	stat, err := fs.Stat("/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode&DMSYMLINK == 0 {
+		t.Errorf("got mode %#x, want DMSYMLINK set", stat.Mode)
+	}
+	if _, err := fs.Open("/link", OREAD); err != ErrNotSupported {
+		t.Errorf("got %v, want %v", err, ErrNotSupported)
+	}
+	if err := fs.CreateFile("/link", 0644); err != ErrAlreadyExists {
+		t.Errorf("got %v, want %v", err, ErrAlreadyExists)
+	}
+}
+
+func TestSymlinkedBasePath(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("root", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for name, opts := range map[string][]LocalFilesystemOption{
+		"follow":    nil,
+		"no follow": {WithoutFollowingSymlinks()},
+	} {
+		fs := NewLocalFilesystem(filepath.Join(dir, "link"), opts...)
+		writeMemFile(t, fs, "/"+name, "data")
+		if b, err := os.ReadFile(filepath.Join(dir, "root", name)); err != nil || string(b) != "data" {
+			t.Errorf("%s: got '%s', %v, want 'data', nil", name, b, err)
+		}
+
+		c := newTestClient(t, fs)
+		if qid := c.attach(0); qid.Ftype != QTDIR {
+			t.Errorf("%s: got root qid type %#x, want %#x", name, qid.Ftype, QTDIR)
+		}
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{name}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 2, Nwname: []string{"..", "secret"}}, &Rwalk{})
+		if err != rerror(ENoSuchFileOrDirectoryStr) {
+			t.Errorf("%s: got %v, want %v", name, err, rerror(ENoSuchFileOrDirectoryStr))
+		}
+		if _, err := fs.Stat("/../secret"); err != ErrDoesNotExist {
+			t.Errorf("%s: got %v, want %v", name, err, ErrDoesNotExist)
+		}
+	}
+}
+
+func TestStatRemovedOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewLocalFilesystem(dir)
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: ORDWR}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Twrite{Tag: 1, Fid: 1, Offset: 0, Data: []byte("data")}, &Rwrite{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "file")); err != nil {
+		t.Fatal(err)
+	}
+	var rstat Rstat
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Name != "file" || rstat.Stat.Length != 4 {
+		t.Errorf("got name %s and length %d, want file and 4", rstat.Stat.Name, rstat.Stat.Length)
+	}
+}
+
+func TestWstatOwner(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewLocalFilesystem(dir)
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	owner := func() (uint32, uint32) {
+		fileInfo, err := os.Stat(filepath.Join(dir, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fileInfo.Sys().(*syscall.Stat_t)
+		return st.Uid, st.Gid
+	}
+	stat := Stat{Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0), Uid: "no-such-user-9p"}
+	if err := fs.Wstat("/file", stat); err != ErrUnknownUser {
+		t.Errorf("got %v, want %v", err, ErrUnknownUser)
+	}
+
+	// Only privileged processes may give files to others.
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	stat.Uid = "nobody"
+	err = fs.Wstat("/file", stat)
+	if os.Geteuid() != 0 {
+		if err != ErrOperationNotPermitted {
+			t.Errorf("got %v, want %v", err, ErrOperationNotPermitted)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid := owner()
+	if want, _ := strconv.Atoi(nobody.Uid); uid != uint32(want) || gid != uint32(os.Getgid()) {
+		t.Errorf("got owner %d:%d, want %d:%d", uid, gid, want, os.Getgid())
+	}
+}
+
+// crossDeviceFilesystem is a Filesystem whose files are on another device than
+// their directories, so that renaming them fails.
+type crossDeviceFilesystem struct {
+	Filesystem
+}
+
+func (f crossDeviceFilesystem) Wstat(path string, stat Stat) error {
+	if stat.Name != "" {
+		return osError(&os.LinkError{Op: "rename", Old: path, New: stat.Name, Err: syscall.EXDEV})
+	}
+	return f.Filesystem.Wstat(path, stat)
+}
+
+func TestCrossDeviceRename(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, crossDeviceFilesystem{fs})
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	stat := Stat{Stype: ^uint16(0), Dev: ^uint32(0), Qid: Qid{^uint8(0), ^uint32(0), ^uint64(0)}, Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0), Name: "renamed"}
+	if err := c.rpc(&Twstat{Tag: 1, Fid: 1, Stat: stat}, &Rwstat{}); err != rerror(ECrossDeviceStr) {
+		t.Errorf("got %v, want %v", err, rerror(ECrossDeviceStr))
+	}
+	// The fid still names the file under its old name.
+	var rstat Rstat
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Name != "file" {
+		t.Errorf("got name %s, want %s", rstat.Stat.Name, "file")
+	}
+}
+
+func TestCrossDeviceError(t *testing.T) {
+	err := osError(&os.LinkError{Op: "rename", Old: "/a", New: "/mnt/b", Err: syscall.EXDEV})
+	if err != ErrCrossDevice {
+		t.Errorf("got %v, want %v", err, ErrCrossDevice)
+	}
+	if got := toNineError(err); got.Msg != ECrossDeviceStr || got.Errno != syscall.EXDEV {
+		t.Errorf("got %+v, want %s and %v", got, ECrossDeviceStr, syscall.EXDEV)
+	}
+}
@@ -0,0 +1,323 @@
+package ninep
+
+import (
+	"math"
+	p "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memFilesystem struct {
+	dev   uint32
+	clock Clock
+
+	mutex      sync.Mutex
+	qidCounter uint64
+	root       *memNode
+}
+
+type memNode struct {
+	name     string
+	qidPath  uint64
+	version  uint32
+	mode     uint32
+	mtime    time.Time
+	atime    time.Time
+	muid     string
+	data     []byte
+	children map[string]*memNode
+}
+
+type memFile struct {
+	fs   *memFilesystem
+	node *memNode
+}
+
+// MemFilesystemOption configures the filesystem returned by NewMemFilesystem.
+type MemFilesystemOption func(*memFilesystem)
+
+// WithMemClock makes the filesystem take the times of its files from clock.
+func WithMemClock(clock Clock) MemFilesystemOption {
+	return func(f *memFilesystem) {
+		f.clock = clock
+	}
+}
+
+func NewMemFilesystem(opts ...MemFilesystemOption) Filesystem {
+	var m memFilesystem
+	m.dev = newSyntheticDev()
+	m.clock = realClock{}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	m.root = m.newNode("/", DMDIR|0755)
+	return &m
+}
+
+func (f *memFilesystem) Open(path string, mode uint8) (File, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	node := f.lookup(path)
+	if node == nil {
+		return nil, ErrDoesNotExist
+	}
+	if mode&OTRUNC != 0 && !node.isDir() {
+		node.data = nil
+		f.modified(node)
+	}
+	node.atime = f.clock.Now()
+	return &memFile{f, node}, nil
+}
+
+func (f *memFilesystem) CreateDir(path string, perm uint32) error {
+	return f.create(path, DMDIR|(perm&0777))
+}
+
+func (f *memFilesystem) CreateFile(path string, perm uint32) error {
+	return f.create(path, perm&(DMAPPEND|DMEXCL|0777))
+}
+
+func (f *memFilesystem) ReadDir(path string) ([]Stat, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	node := f.lookup(path)
+	if node == nil {
+		return nil, ErrDoesNotExist
+	}
+	if !node.isDir() {
+		return nil, ErrIOError
+	}
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]Stat, len(names))
+	for i, name := range names {
+		stats[i] = f.stat(node.children[name])
+	}
+	return stats, nil
+}
+
+func (f *memFilesystem) Remove(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	parent := f.lookup(p.Dir(p.Clean("/" + path)))
+	name := p.Base(p.Clean("/" + path))
+	if parent == nil || !parent.isDir() || parent.children[name] == nil {
+		return ErrDoesNotExist
+	}
+	if len(parent.children[name].children) != 0 {
+		return ErrDirectoryNotEmpty
+	}
+	delete(parent.children, name)
+	f.modified(parent)
+	return nil
+}
+
+func (f *memFilesystem) Stat(path string) (Stat, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	node := f.lookup(path)
+	if node == nil {
+		return Stat{}, ErrDoesNotExist
+	}
+	return f.stat(node), nil
+}
+
+func (f *memFilesystem) Wstat(path string, stat Stat) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	node := f.lookup(path)
+	if node == nil {
+		return ErrDoesNotExist
+	}
+	parent := f.lookup(p.Dir(p.Clean("/" + path)))
+	if stat.Name != "" {
+		if node == f.root {
+			return ErrPermissionDenied
+		}
+		if parent.children[stat.Name] != nil {
+			return ErrAlreadyExists
+		}
+	}
+	if stat.Mode != ^uint32(0) {
+		node.mode = (node.mode & DMDIR) | (stat.Mode & (DMAPPEND | DMEXCL | 0777))
+		if node.isDir() {
+			node.mode &^= DMAPPEND | DMEXCL
+		}
+	}
+	// The length of a directory is always zero and may only be set to zero.
+	if stat.Length != ^uint64(0) && !(node.isDir() && stat.Length == 0) {
+		if node.isDir() || stat.Length > math.MaxInt32 {
+			return ErrIOError
+		}
+		resized := make([]byte, stat.Length)
+		copy(resized, node.data)
+		node.data = resized
+		f.modified(node)
+	}
+	if stat.Name != "" {
+		delete(parent.children, node.name)
+		node.name = stat.Name
+		parent.children[node.name] = node
+		f.modified(parent)
+	}
+	return nil
+}
+
+func (f *memFilesystem) SetMuid(path string, uname string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if node := f.lookup(path); node != nil {
+		node.muid = uname
+	}
+}
+
+// Snapshot returns a copy of the filesystem, which does not change when the
+// filesystem does.
+func (f *memFilesystem) Snapshot() Filesystem {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return &memFilesystem{dev: f.dev, clock: f.clock, qidCounter: f.qidCounter, root: f.root.copy()}
+}
+
+func (f *memFilesystem) create(path string, mode uint32) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path = p.Clean("/" + path)
+	parent := f.lookup(p.Dir(path))
+	if parent == nil || !parent.isDir() {
+		return ErrDoesNotExist
+	}
+	name := p.Base(path)
+	if parent.children[name] != nil {
+		return ErrAlreadyExists
+	}
+	parent.children[name] = f.newNode(name, mode)
+	f.modified(parent)
+	return nil
+}
+
+func (f *memFilesystem) newNode(name string, mode uint32) *memNode {
+	now := f.clock.Now()
+	node := &memNode{name: name, qidPath: f.qidCounter, mode: mode, mtime: now, atime: now}
+	f.qidCounter += 1
+	if mode&DMDIR != 0 {
+		node.children = make(map[string]*memNode)
+	}
+	return node
+}
+
+func (f *memFilesystem) lookup(path string) *memNode {
+	node := f.root
+	for _, name := range strings.Split(p.Clean("/"+path), "/") {
+		if name == "" {
+			continue
+		}
+		if !node.isDir() {
+			return nil
+		}
+		node = node.children[name]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+func (f *memFilesystem) stat(node *memNode) Stat {
+	return Stat{
+		Dev:    f.dev,
+		Qid:    node.qid(),
+		Mode:   node.mode,
+		Length: uint64(len(node.data)),
+		Name:   node.name,
+		Uid:    "?",
+		Gid:    "?",
+		Muid:   node.muid,
+		Atime:  uint32(node.atime.Unix()),
+		Mtime:  uint32(node.mtime.Unix()),
+	}
+}
+
+func (n *memNode) copy() *memNode {
+	c := *n
+	c.data = append([]byte(nil), n.data...)
+	if n.children != nil {
+		c.children = make(map[string]*memNode, len(n.children))
+		for name, child := range n.children {
+			c.children[name] = child.copy()
+		}
+	}
+	return &c
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode&DMDIR != 0
+}
+
+func (n *memNode) qid() Qid {
+	return Qid{qidType(n.mode), n.version, n.qidPath}
+}
+
+func (f *memFilesystem) modified(n *memNode) {
+	n.version += 1
+	n.mtime = f.clock.Now()
+}
+
+func (f *memFile) Qid() Qid {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	return f.node.qid()
+}
+
+func (f *memFile) IsDir() bool {
+	return f.node.isDir()
+}
+
+func (f *memFile) Stat() (Stat, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	return f.fs.stat(f.node), nil
+}
+
+func (f *memFile) Read(offset uint64, count uint32) ([]byte, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	f.node.atime = f.fs.clock.Now()
+	data := sliceAt(f.node.data, offset, count)
+	return append(make([]byte, 0, len(data)), data...), nil
+}
+
+func (f *memFile) Write(offset uint64, data []byte) error {
+	if f.IsDir() {
+		return ErrIOError
+	}
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.node.mode&DMAPPEND != 0 {
+		offset = uint64(len(f.node.data))
+	}
+	end := offset + uint64(len(data))
+	if end < offset || end > math.MaxInt32 {
+		return ErrIOError
+	}
+	if end > uint64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[offset:], data)
+	f.fs.modified(f.node)
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() {
+}
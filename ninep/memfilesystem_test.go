@@ -0,0 +1,74 @@
+package ninep
+
+import (
+	"testing"
+)
+
+func TestMemFilesystemReadWrite(t *testing.T) {
+	fs := NewMemFilesystem()
+	err := fs.CreateDir("/dir", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.CreateFile("/dir/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open("/dir/file", ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = file.Write(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := file.Read(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ell" {
+		t.Errorf("got '%s', want '%s'", data, "ell")
+	}
+	stats, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != "file" || stats[0].Length != 5 {
+		t.Errorf("got %+v, want a single 5 byte entry named 'file'", stats)
+	}
+	if err := fs.Remove("/dir"); err != ErrDirectoryNotEmpty {
+		t.Errorf("got %v, want %v", err, ErrDirectoryNotEmpty)
+	}
+}
+
+func TestMemFilesystemDev(t *testing.T) {
+	fs1 := NewMemFilesystem()
+	fs2 := NewMemFilesystem()
+	for _, fs := range []Filesystem{fs1, fs2} {
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stat1, err := fs1.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat2, err := fs2.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat1.Qid.Path != stat2.Qid.Path {
+		t.Fatalf("got qid paths %d and %d, want equal", stat1.Qid.Path, stat2.Qid.Path)
+	}
+	if stat1.Dev == stat2.Dev {
+		t.Errorf("got equal dev %d for both filesystems, want distinct", stat1.Dev)
+	}
+	rootStat, err := fs1.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootStat.Dev != stat1.Dev {
+		t.Errorf("got dev %d, want %d", rootStat.Dev, stat1.Dev)
+	}
+}
@@ -0,0 +1,744 @@
+package ninep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+const (
+	TversionType = 100
+	RversionType = 101
+	TauthType    = 102
+	RauthType    = 103
+	TattachType  = 104
+	RattachType  = 105
+	RerrorType   = 107
+	TflushType   = 108
+	RflushType   = 109
+	TwalkType    = 110
+	RwalkType    = 111
+	TopenType    = 112
+	RopenType    = 113
+	TcreateType  = 114
+	RcreateType  = 115
+	TreadType    = 116
+	RreadType    = 117
+	TwriteType   = 118
+	RwriteType   = 119
+	TclunkType   = 120
+	RclunkType   = 121
+	TremoveType  = 122
+	RremoveType  = 123
+	TstatType    = 124
+	RstatType    = 125
+	TwstatType   = 126
+	RwstatType   = 127
+
+	// Messages of the 9P2000.e dialect.
+	TsessionType = 150
+	RsessionType = 151
+	TsreadType   = 152
+	RsreadType   = 153
+	TswriteType  = 154
+	RswriteType  = 155
+
+	QTDIR     = 0x80
+	QTAPPEND  = 0x40
+	QTEXCL    = 0x20
+	QTMOUNT   = 0x10
+	QTAUTH    = 0x08
+	QTTMP     = 0x04
+	QTSYMLINK = 0x02
+	QTFILE    = 0x00
+
+	DMDIR     = 0x80000000
+	DMAPPEND  = 0x40000000
+	DMEXCL    = 0x20000000
+	DMMOUNT   = 0x10000000
+	DMAUTH    = 0x08000000
+	DMTMP     = 0x04000000
+	DMSYMLINK = 0x02000000
+
+	DMDEVICE    = 0x00800000
+	DMNAMEDPIPE = 0x00200000
+	DMSOCKET    = 0x00100000
+
+	OREAD   = 0
+	OWRITE  = 1
+	ORDWR   = 2
+	OEXEC   = 3
+	OTRUNC  = 0x10
+	ORCLOSE = 0x40
+
+	NOFID = 0xFFFFFFFF
+
+	// MAXWELEM is the largest number of names a Twalk may hold.
+	MAXWELEM = 16
+
+	// IOHDRSZ is the size of the Twrite and Rread headers preceding the data.
+	IOHDRSZ = 24
+
+	ProtocolVersion = "9P2000"
+	// ProtocolVersionE is the 9P2000.e dialect, adding Tsread and Tswrite to
+	// read or write a whole file in a single round trip.
+	ProtocolVersionE = "9P2000.e"
+)
+
+// IsSupportedVersion reports whether version is a protocol version the server
+// can speak.
+func IsSupportedVersion(version string) bool {
+	return version == ProtocolVersion || version == ProtocolVersionE
+}
+
+type Qid struct {
+	Ftype   uint8
+	Version uint32
+	Path    uint64
+}
+
+type Tauth struct {
+	Tag   uint16
+	Afid  uint32
+	Uname string
+	Aname string
+}
+
+type Rauth struct {
+	Tag  uint16
+	Aqid Qid
+}
+
+type Tattach struct {
+	Tag   uint16
+	Fid   uint32
+	Afid  uint32
+	Uname string
+	Aname string
+}
+
+type Rattach struct {
+	Tag uint16
+	Qid Qid
+}
+
+type Tclunk struct {
+	Tag uint16
+	Fid uint32
+}
+
+type Rclunk struct {
+	Tag uint16
+}
+
+type Tflush struct {
+	Tag    uint16
+	Oldtag uint16
+}
+
+type Rflush struct {
+	Tag uint16
+}
+
+type Topen struct {
+	Tag  uint16
+	Fid  uint32
+	Mode uint8
+}
+
+type Ropen struct {
+	Tag    uint16
+	Qid    Qid
+	Iouint uint32
+}
+
+type Tcreate struct {
+	Tag  uint16
+	Fid  uint32
+	Name string
+	Perm uint32
+	Mode uint8
+}
+
+type Rcreate struct {
+	Tag    uint16
+	Qid    Qid
+	Iouint uint32
+}
+
+type Tread struct {
+	Tag    uint16
+	Fid    uint32
+	Offset uint64
+	Count  uint32
+}
+
+type Rread struct {
+	Tag  uint16
+	Data []byte
+}
+
+type Twrite struct {
+	Tag    uint16
+	Fid    uint32
+	Offset uint64
+	Data   []byte
+}
+
+type Rwrite struct {
+	Tag   uint16
+	Count uint32
+}
+
+type Tremove struct {
+	Tag uint16
+	Fid uint32
+}
+
+type Rremove struct {
+	Tag uint16
+}
+
+type Tstat struct {
+	Tag uint16
+	Fid uint32
+}
+
+type Rstat struct {
+	Tag  uint16
+	Stat Stat
+}
+
+type Twstat struct {
+	Tag  uint16
+	Fid  uint32
+	Stat Stat
+}
+
+type Rwstat struct {
+	Tag uint16
+}
+
+type Tversion struct {
+	Tag     uint16
+	Msize   uint32
+	Version string
+}
+
+type Rversion struct {
+	Tag     uint16
+	Msize   uint32
+	Version string
+}
+
+type Twalk struct {
+	Tag    uint16
+	Fid    uint32
+	Newfid uint32
+	Nwname []string
+}
+
+type Rwalk struct {
+	Tag   uint16
+	Nwqid []Qid
+}
+
+type Rerror struct {
+	Tag   uint16
+	Ename string
+}
+
+type Tsession struct {
+	Tag uint16
+	Key uint64
+}
+
+type Rsession struct {
+	Tag uint16
+}
+
+type Tsread struct {
+	Tag    uint16
+	Fid    uint32
+	Nwname []string
+}
+
+type Rsread struct {
+	Tag  uint16
+	Data []byte
+}
+
+type Tswrite struct {
+	Tag    uint16
+	Fid    uint32
+	Nwname []string
+	Data   []byte
+}
+
+type Rswrite struct {
+	Tag   uint16
+	Count uint32
+}
+
+type Stat struct {
+	Stype  uint16
+	Dev    uint32
+	Qid    Qid
+	Mode   uint32
+	Atime  uint32
+	Mtime  uint32
+	Length uint64
+	Name   string
+	Uid    string
+	Gid    string
+	Muid   string
+}
+
+// message is implemented by every message, giving the tag of a message without
+// knowing its type.
+type message interface {
+	tag() uint16
+}
+
+func (m *Tauth) tag() uint16    { return m.Tag }
+func (m *Rauth) tag() uint16    { return m.Tag }
+func (m *Tattach) tag() uint16  { return m.Tag }
+func (m *Rattach) tag() uint16  { return m.Tag }
+func (m *Tclunk) tag() uint16   { return m.Tag }
+func (m *Rclunk) tag() uint16   { return m.Tag }
+func (m *Tflush) tag() uint16   { return m.Tag }
+func (m *Rflush) tag() uint16   { return m.Tag }
+func (m *Topen) tag() uint16    { return m.Tag }
+func (m *Ropen) tag() uint16    { return m.Tag }
+func (m *Tcreate) tag() uint16  { return m.Tag }
+func (m *Rcreate) tag() uint16  { return m.Tag }
+func (m *Tread) tag() uint16    { return m.Tag }
+func (m *Rread) tag() uint16    { return m.Tag }
+func (m *Twrite) tag() uint16   { return m.Tag }
+func (m *Rwrite) tag() uint16   { return m.Tag }
+func (m *Tremove) tag() uint16  { return m.Tag }
+func (m *Rremove) tag() uint16  { return m.Tag }
+func (m *Tstat) tag() uint16    { return m.Tag }
+func (m *Rstat) tag() uint16    { return m.Tag }
+func (m *Twstat) tag() uint16   { return m.Tag }
+func (m *Rwstat) tag() uint16   { return m.Tag }
+func (m *Tversion) tag() uint16 { return m.Tag }
+func (m *Rversion) tag() uint16 { return m.Tag }
+func (m *Twalk) tag() uint16    { return m.Tag }
+func (m *Rwalk) tag() uint16    { return m.Tag }
+func (m *Rerror) tag() uint16   { return m.Tag }
+func (m *Tsession) tag() uint16 { return m.Tag }
+func (m *Rsession) tag() uint16 { return m.Tag }
+func (m *Tsread) tag() uint16   { return m.Tag }
+func (m *Rsread) tag() uint16   { return m.Tag }
+func (m *Tswrite) tag() uint16  { return m.Tag }
+func (m *Rswrite) tag() uint16  { return m.Tag }
+
+var messageConstructors = make(map[uint8]func() any)
+var messageTypes = make(map[reflect.Type]uint8)
+
+// registerMessage associates the message struct T with its type byte on the
+// wire, for both DeserializeMessage and SerializeMessage.
+func registerMessage[T any](mtype uint8) {
+	messageConstructors[mtype] = func() any {
+		return new(T)
+	}
+	messageTypes[reflect.TypeOf((*T)(nil))] = mtype
+}
+
+func init() {
+	registerMessage[Tversion](TversionType)
+	registerMessage[Rversion](RversionType)
+	registerMessage[Tauth](TauthType)
+	registerMessage[Rauth](RauthType)
+	registerMessage[Tattach](TattachType)
+	registerMessage[Rattach](RattachType)
+	registerMessage[Rerror](RerrorType)
+	registerMessage[Tflush](TflushType)
+	registerMessage[Rflush](RflushType)
+	registerMessage[Twalk](TwalkType)
+	registerMessage[Rwalk](RwalkType)
+	registerMessage[Topen](TopenType)
+	registerMessage[Ropen](RopenType)
+	registerMessage[Tcreate](TcreateType)
+	registerMessage[Rcreate](RcreateType)
+	registerMessage[Tread](TreadType)
+	registerMessage[Rread](RreadType)
+	registerMessage[Twrite](TwriteType)
+	registerMessage[Rwrite](RwriteType)
+	registerMessage[Tclunk](TclunkType)
+	registerMessage[Rclunk](RclunkType)
+	registerMessage[Tremove](TremoveType)
+	registerMessage[Rremove](RremoveType)
+	registerMessage[Tstat](TstatType)
+	registerMessage[Rstat](RstatType)
+	registerMessage[Twstat](TwstatType)
+	registerMessage[Rwstat](RwstatType)
+	registerMessage[Tsession](TsessionType)
+	registerMessage[Rsession](RsessionType)
+	registerMessage[Tsread](TsreadType)
+	registerMessage[Rsread](RsreadType)
+	registerMessage[Tswrite](TswriteType)
+	registerMessage[Rswrite](RswriteType)
+}
+
+func (s Stat) Serialize(w io.Writer) error {
+	return serializeStat(w, reflect.ValueOf(s), reflect.TypeOf(s), false)
+}
+
+func DeserializeMessage(r io.Reader) (interface{}, error) {
+	frame, err := sizePrefixFramer{}.ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalMessage(frame)
+}
+
+// unmarshalMessage decodes a message from a frame holding its type, tag and
+// fields.
+func unmarshalMessage(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty message")
+	}
+	newMessage, ok := messageConstructors[b[0]]
+	if !ok {
+		return nil, errors.New("unknown message type")
+	}
+	msg := newMessage()
+	err := deserializeMessage2(bytes.NewReader(b[1:]), msg)
+	return msg, err
+}
+
+// errTooManyNames is returned when a message holds more than MAXWELEM names
+// or qids, before memory is allocated for them.
+var errTooManyNames = errors.New("too many names in walk")
+
+func deserializeMessage2(r io.Reader, value any) error {
+	return deserializeMessage3(r, reflect.ValueOf(value).Elem())
+}
+
+func deserializeMessage3(r io.Reader, v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		fi := f.Interface()
+		switch fi.(type) {
+		case uint8:
+			r, err := readUint[uint8](r)
+			if err != nil {
+				return err
+			}
+			f.SetUint(uint64(r))
+		case uint16:
+			r, err := readUint[uint16](r)
+			if err != nil {
+				return err
+			}
+			f.SetUint(uint64(r))
+		case uint32:
+			r, err := readUint[uint32](r)
+			if err != nil {
+				return err
+			}
+			f.SetUint(uint64(r))
+		case uint64:
+			r, err := readUint[uint64](r)
+			if err != nil {
+				return err
+			}
+			f.SetUint(r)
+		case string:
+			r, err := readString(r)
+			if err != nil {
+				return err
+			}
+			f.SetString(r)
+		case []string:
+			count, err := readUint[uint16](r)
+			if err != nil {
+				return err
+			}
+			if count > MAXWELEM {
+				return errTooManyNames
+			}
+			arr := make([]string, count)
+			for i := uint16(0); i < count; i++ {
+				arr[i], err = readString(r)
+				if err != nil {
+					return err
+				}
+			}
+			f.Set(reflect.ValueOf(arr))
+		case []Qid:
+			count, err := readUint[uint16](r)
+			if err != nil {
+				return err
+			}
+			if count > MAXWELEM {
+				return errTooManyNames
+			}
+			arr := make([]Qid, count)
+			for i := uint16(0); i < count; i++ {
+				err = deserializeMessage3(r, reflect.ValueOf(&arr[i]).Elem())
+				if err != nil {
+					return err
+				}
+			}
+			f.Set(reflect.ValueOf(arr))
+		case []byte:
+			count, err := readUint[uint32](r)
+			if err != nil {
+				return err
+			}
+			buff, err := readBuff(r, int64(count))
+			if err != nil {
+				return err
+			}
+			f.Set(reflect.ValueOf(buff))
+		case Stat:
+			stat, err := readStat(r)
+			if err != nil {
+				return err
+			}
+			f.Set(reflect.ValueOf(stat))
+		default:
+			if f.Kind() == reflect.Struct {
+				err := deserializeMessage3(r, f)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			return fmt.Errorf("unknown field type: %s", f.Type().String())
+		}
+	}
+	return nil
+}
+
+func SerializeMessage(w io.Writer, value any) error {
+	b := getBuffer()
+	defer putBuffer(b)
+	err := marshalMessage(b, value)
+	if err != nil {
+		return err
+	}
+	return sizePrefixFramer{}.WriteFrame(w, b.Bytes())
+}
+
+// marshalMessage appends the frame of value, its type, tag and fields, to b.
+func marshalMessage(b *bytes.Buffer, value any) error {
+	mtype := getMessageType(value)
+	if mtype == 0 {
+		return errors.New("bad message type")
+	}
+	b.WriteByte(mtype)
+	return serializeMessage2(b, reflect.ValueOf(value).Elem(), reflect.TypeOf(value).Elem())
+}
+
+func serializeMessage2(w io.Writer, v reflect.Value, t reflect.Type) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		fi := f.Interface()
+		switch c := fi.(type) {
+		case uint8:
+			err := writeUint(w, c)
+			if err != nil {
+				return err
+			}
+		case uint16:
+			err := writeUint(w, c)
+			if err != nil {
+				return err
+			}
+		case uint32:
+			err := writeUint(w, c)
+			if err != nil {
+				return err
+			}
+		case uint64:
+			err := writeUint(w, c)
+			if err != nil {
+				return err
+			}
+		case string:
+			err := writeString(w, c)
+			if err != nil {
+				return err
+			}
+		case []string:
+			err := writeUint(w, uint16(len(c)))
+			if err != nil {
+				return err
+			}
+			for _, v := range c {
+				err = writeString(w, v)
+				if err != nil {
+					return err
+				}
+			}
+		case []Qid:
+			err := writeUint(w, uint16(len(c)))
+			if err != nil {
+				return err
+			}
+			for _, v := range c {
+				err = serializeMessage2(w, reflect.ValueOf(v), reflect.TypeOf(v))
+				if err != nil {
+					return err
+				}
+			}
+		case []byte:
+			err := writeUint(w, uint32(len(c)))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(c)
+			if err != nil {
+				return err
+			}
+		case Stat:
+			err := serializeStat(w, f, f.Type(), true)
+			if err != nil {
+				return err
+			}
+		default:
+			if f.Kind() == reflect.Struct {
+				err := serializeMessage2(w, f, f.Type())
+				if err != nil {
+					return err
+				}
+			} else {
+				return fmt.Errorf("unknown field type: %s", f.Type().String())
+			}
+		}
+	}
+	return nil
+}
+
+func serializeStat(w io.Writer, v reflect.Value, t reflect.Type, writeLength bool) error {
+	b := getBuffer()
+	defer putBuffer(b)
+	err := serializeMessage2(b, v, t)
+	if err != nil {
+		return err
+	}
+	if writeLength {
+		err = writeUint(w, uint16(b.Len()+2))
+		if err != nil {
+			return err
+		}
+	}
+	err = writeUint(w, uint16(b.Len()))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, b)
+	return err
+}
+
+// maxPooledBufferSize is the capacity above which buffers are left to the
+// garbage collector instead of being kept in bufferPool.
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// errNotRequest is returned for messages sent to the server which are not
+// T-messages.
+var errNotRequest = errors.New("reply message sent as a request")
+
+// isRequest reports whether v is a T-message. T-messages have even types, the
+// R-message answering one has the next type.
+func isRequest(v interface{}) bool {
+	return getMessageType(v)%2 == 0
+}
+
+func getMessageType(v interface{}) uint8 {
+	return messageTypes[reflect.TypeOf(v)]
+}
+
+// errBadStat is returned for a stat whose sizes do not match the bytes
+// holding it.
+var errBadStat = errors.New("malformed stat")
+
+// readStat reads a stat preceded by its size, as messages hold it. The size
+// and the size the stat starts with must both cover exactly its fields.
+func readStat(r io.Reader) (Stat, error) {
+	var stat Stat
+	n, err := readUint[uint16](r)
+	if err != nil {
+		return stat, err
+	}
+	b, err := readBuff(r, int64(n))
+	if err != nil {
+		return stat, errBadStat
+	}
+	if n < 2 || binary.LittleEndian.Uint16(b) != n-2 {
+		return stat, errBadStat
+	}
+	sr := bytes.NewReader(b[2:])
+	err = deserializeMessage3(sr, reflect.ValueOf(&stat).Elem())
+	if err != nil || sr.Len() != 0 {
+		return stat, errBadStat
+	}
+	return stat, nil
+}
+
+func readBuff(r io.Reader, size int64) ([]byte, error) {
+	buff := make([]byte, size)
+	_, err := io.ReadFull(r, buff)
+	if err != nil {
+		return nil, err
+	}
+	return buff, nil
+}
+
+func readUint[K uint8 | uint16 | uint32 | uint64](r io.Reader) (K, error) {
+	var result K
+	err := binary.Read(r, binary.LittleEndian, &result)
+	return result, err
+}
+
+func writeUint[K uint8 | uint16 | uint32 | uint64](w io.Writer, v K) error {
+	return binary.Write(w, binary.LittleEndian, v)
+}
+
+func readString(r io.Reader) (string, error) {
+	strSize, err := readUint[uint16](r)
+	if err != nil {
+		return "", err
+	}
+	str, err := readBuff(r, int64(strSize))
+	if err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
+func writeString(w io.Writer, s string) error {
+	bytes := []byte(s)
+	err := writeUint(w, uint16(len(bytes)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
@@ -0,0 +1,273 @@
+package ninep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestDeserializingMessages(t *testing.T) {
+	input, err := hex.DecodeString("19000000665500010000000500756E616D650500616E616D65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bytes.NewReader(input)
+	msg, err := DeserializeMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authMsg, ok := msg.(*Tauth)
+	if !ok {
+		t.Fatalf("wrong message type, got %T, want *Tauth", msg)
+	}
+	authMsgExcepted := Tauth{Tag: 0x55, Afid: 0x01, Uname: "uname", Aname: "aname"}
+	if authMsg.Tag != authMsgExcepted.Tag {
+		t.Errorf("got %d, want %d", authMsg.Tag, authMsgExcepted.Tag)
+	}
+	if authMsg.Afid != authMsgExcepted.Afid {
+		t.Errorf("got %d, want %d", authMsg.Afid, authMsgExcepted.Afid)
+	}
+	if authMsg.Uname != authMsgExcepted.Uname {
+		t.Errorf("got %s, want %s", authMsg.Uname, authMsgExcepted.Uname)
+	}
+	if authMsg.Aname != authMsgExcepted.Aname {
+		t.Errorf("got %s, want %s", authMsg.Aname, authMsgExcepted.Aname)
+	}
+
+	input, err = hex.DecodeString("3E0000007E00000100000031002F00FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFBA0E3263BA0E3263FFFFFFFFFFFFFFFF0000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = bytes.NewReader(input)
+	msg, err = DeserializeMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twstatMsg, ok := msg.(*Twstat)
+	if !ok {
+		t.Fatalf("wrong message type, got %T, want *Twstat", msg)
+	}
+	twstatExcepted := Twstat{Tag: 0, Fid: 1, Stat: Stat{Length: 0xFFFFFFFFFFFFFFFF}}
+	if twstatMsg.Tag != twstatExcepted.Tag {
+		t.Errorf("got %d, want %d", twstatMsg.Tag, twstatExcepted.Tag)
+	}
+	if twstatMsg.Fid != twstatExcepted.Fid {
+		t.Errorf("got %d, want %d", twstatMsg.Fid, twstatExcepted.Fid)
+	}
+	if twstatMsg.Stat.Length != twstatExcepted.Stat.Length {
+		t.Errorf("got %d, want %d", twstatMsg.Stat.Length, twstatExcepted.Stat.Length)
+	}
+}
+
+func TestDeserializingDontTouchStat(t *testing.T) {
+	// A Twstat whose stat only holds the values which leave a field as it is.
+	input, err := hex.DecodeString("3E0000007E010001000000" + "31002F00" + "FFFFFFFFFFFF" + "FFFFFFFFFFFFFFFFFFFFFFFFFF" +
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF" + "0000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DeserializeMessage(bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twstat, ok := msg.(*Twstat)
+	if !ok {
+		t.Fatalf("wrong message type, got %T, want *Twstat", msg)
+	}
+	want := Twstat{Tag: 1, Fid: 1, Stat: Stat{
+		Stype:  ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{^uint8(0), ^uint32(0), ^uint64(0)},
+		Mode:   ^uint32(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}}
+	if !reflect.DeepEqual(*twstat, want) {
+		t.Errorf("got %+v, want %+v", *twstat, want)
+	}
+}
+
+func TestDeserializingTooManyNames(t *testing.T) {
+	// A Twalk claiming 65535 names, followed by none of them.
+	input, err := hex.DecodeString("110000006E0100" + "01000000" + "02000000" + "FFFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = DeserializeMessage(bytes.NewReader(input))
+	runtime.ReadMemStats(&after)
+	if err != errTooManyNames {
+		t.Errorf("got %v, want %v", err, errTooManyNames)
+	}
+	// The slice for the names would take a megabyte.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64*1024 {
+		t.Errorf("got %d bytes allocated, want at most %d", allocated, 64*1024)
+	}
+}
+
+func TestSerializingMessages(t *testing.T) {
+	versionMsg := Rversion{Tag: 0x75, Msize: 0x15, Version: "test"}
+	b := new(bytes.Buffer)
+	err := SerializeMessage(b, &versionMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultHex := hex.EncodeToString(b.Bytes())
+	exceptedResult := "1100000065750015000000040074657374"
+	if resultHex != exceptedResult {
+		t.Errorf("got '%s', want '%s'", resultHex, exceptedResult)
+	}
+}
+
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func BenchmarkDeserializeSmallMessages(b *testing.B) {
+	clunk, err := hex.DecodeString("0B000000780100FFFFFFFF")
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := bytes.Repeat(clunk, 1000)
+	run := func(b *testing.B, wrap func(io.Reader) io.Reader) {
+		var reads int
+		for i := 0; i < b.N; i++ {
+			counter := &countingReader{r: bytes.NewReader(input)}
+			r := wrap(counter)
+			for j := 0; j < 1000; j++ {
+				if _, err := DeserializeMessage(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reads += counter.reads
+		}
+		b.ReportMetric(float64(reads)/float64(b.N*1000), "reads/msg")
+	}
+	b.Run("direct", func(b *testing.B) {
+		run(b, func(r io.Reader) io.Reader { return r })
+	})
+	b.Run("buffered", func(b *testing.B) {
+		run(b, func(r io.Reader) io.Reader { return bufio.NewReader(r) })
+	})
+}
+
+func TestMessageRegistryRoundTrip(t *testing.T) {
+	qid := Qid{Ftype: QTAUTH, Version: 3, Path: 42}
+	stat := Stat{Stype: 1, Dev: 2, Qid: qid, Mode: 0644, Atime: 5, Mtime: 6, Length: 7, Name: "name", Uid: "uid", Gid: "gid", Muid: "muid"}
+	messages := []any{
+		&Tversion{Tag: 1, Msize: 8192, Version: ProtocolVersion},
+		&Rversion{Tag: 1, Msize: 8192, Version: ProtocolVersion},
+		&Tauth{Tag: 1, Afid: 2, Uname: "uname", Aname: "aname"},
+		&Rauth{Tag: 1, Aqid: qid},
+		&Tattach{Tag: 1, Fid: 2, Afid: NOFID, Uname: "uname", Aname: "aname"},
+		&Rattach{Tag: 1, Qid: qid},
+		&Rerror{Tag: 1, Ename: "error"},
+		&Tflush{Tag: 1, Oldtag: 2},
+		&Rflush{Tag: 1},
+		&Twalk{Tag: 1, Fid: 2, Newfid: 3, Nwname: []string{"a", "b"}},
+		&Rwalk{Tag: 1, Nwqid: []Qid{qid, qid}},
+		&Topen{Tag: 1, Fid: 2, Mode: ORDWR},
+		&Ropen{Tag: 1, Qid: qid, Iouint: 4},
+		&Tcreate{Tag: 1, Fid: 2, Name: "name", Perm: 0644, Mode: OWRITE},
+		&Rcreate{Tag: 1, Qid: qid, Iouint: 4},
+		&Tread{Tag: 1, Fid: 2, Offset: 3, Count: 4},
+		&Rread{Tag: 1, Data: []byte("data")},
+		&Twrite{Tag: 1, Fid: 2, Offset: 3, Data: []byte("data")},
+		&Rwrite{Tag: 1, Count: 4},
+		&Tclunk{Tag: 1, Fid: 2},
+		&Rclunk{Tag: 1},
+		&Tremove{Tag: 1, Fid: 2},
+		&Rremove{Tag: 1},
+		&Tstat{Tag: 1, Fid: 2},
+		&Rstat{Tag: 1, Stat: stat},
+		&Twstat{Tag: 1, Fid: 2, Stat: stat},
+		&Rwstat{Tag: 1},
+		&Tsession{Tag: 1, Key: 2},
+		&Rsession{Tag: 1},
+		&Tsread{Tag: 1, Fid: 2, Nwname: []string{"a", "b"}},
+		&Rsread{Tag: 1, Data: []byte("data")},
+		&Tswrite{Tag: 1, Fid: 2, Nwname: []string{"a", "b"}, Data: []byte("data")},
+		&Rswrite{Tag: 1, Count: 4},
+	}
+	if len(messages) != len(messageConstructors) {
+		t.Errorf("got %d registered messages, want %d", len(messageConstructors), len(messages))
+	}
+	for _, msg := range messages {
+		if msg.(message).tag() != 1 {
+			t.Errorf("%T: got tag %d, want %d", msg, msg.(message).tag(), 1)
+		}
+		b := new(bytes.Buffer)
+		err := SerializeMessage(b, msg)
+		if err != nil {
+			t.Errorf("%T: %v", msg, err)
+			continue
+		}
+		result, err := DeserializeMessage(b)
+		if err != nil {
+			t.Errorf("%T: %v", msg, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, msg) {
+			t.Errorf("got %+v, want %+v", result, msg)
+		}
+	}
+}
+
+func BenchmarkSerializeDirectoryListing(b *testing.B) {
+	stats := make([]Stat, 1000)
+	for i := range stats {
+		stats[i] = Stat{Qid: Qid{Path: uint64(i)}, Mode: 0644, Length: uint64(i), Name: fmt.Sprintf("file%d", i), Uid: "?", Gid: "?"}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer := new(bytes.Buffer)
+		for _, stat := range stats {
+			if err := stat.Serialize(buffer); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := SerializeMessage(io.Discard, &Rread{Tag: 1, Data: buffer.Bytes()}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// reflectTag is how the tag of a message was found before messages had a tag
+// method.
+func reflectTag(msg any) uint16 {
+	return uint16(reflect.ValueOf(msg).Elem().FieldByName("Tag").Uint())
+}
+
+func BenchmarkMessageTag(b *testing.B) {
+	messages := []any{
+		&Twalk{Tag: 1, Fid: 2, Newfid: 3, Nwname: []string{"missing"}},
+		&Topen{Tag: 2, Fid: 7, Mode: OREAD},
+		&Tread{Tag: 3, Fid: 7, Count: 16},
+		&Tstat{Tag: 4, Fid: 7},
+	}
+	b.Run("Reflection", func(b *testing.B) {
+		var sum uint16
+		for i := 0; i < b.N; i++ {
+			sum += reflectTag(messages[i%len(messages)])
+		}
+	})
+	b.Run("Method", func(b *testing.B) {
+		var sum uint16
+		for i := 0; i < b.N; i++ {
+			sum += messages[i%len(messages)].(message).tag()
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package ninep
+
+import (
+	p "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// treeQidShift is the position of the number of a tree in the qid paths of its
+// files, so files of different trees never share one. The bits below it and
+// overlayQidBit are kept from the qid path the tree reports. Tree numbers
+// start at 1, the qid path 0 of tree 0 is the root.
+const treeQidShift = 48
+
+const treeQidMask = (1<<15 - 1) << treeQidShift
+
+// multiFilesystem serves several filesystems as the directories of a
+// read-only root, so clients attach to one of them by its name or to the root
+// with an empty aname.
+type multiFilesystem struct {
+	dev       uint32
+	trees     map[string]Filesystem
+	numbers   map[string]uint64
+	clock     Clock
+	startTime time.Time
+}
+
+// MultiFilesystemOption configures the filesystem returned by
+// NewMultiFilesystem.
+type MultiFilesystemOption func(*multiFilesystem)
+
+// WithMultiClock makes the filesystem take the times of its root from clock.
+func WithMultiClock(clock Clock) MultiFilesystemOption {
+	return func(f *multiFilesystem) {
+		f.clock = clock
+	}
+}
+
+// multiRootFile is the open root directory of a multiFilesystem.
+type multiRootFile struct {
+	fs *multiFilesystem
+}
+
+// multiFile is an open file of a tree of a multiFilesystem.
+type multiFile struct {
+	File
+	number uint64
+}
+
+// NewMultiFilesystem returns a filesystem whose root lists the names of trees,
+// each of them serving the corresponding filesystem.
+func NewMultiFilesystem(trees map[string]Filesystem, opts ...MultiFilesystemOption) Filesystem {
+	names := make([]string, 0, len(trees))
+	for name := range trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	numbers := make(map[string]uint64, len(names))
+	for i, name := range names {
+		numbers[name] = uint64(i + 1)
+	}
+	f := &multiFilesystem{dev: newSyntheticDev(), trees: trees, numbers: numbers, clock: realClock{}}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.startTime = f.clock.Now()
+	return f
+}
+
+func (f *multiFilesystem) Open(path string, mode uint8) (File, error) {
+	tree, treePath, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		if mode&3 != OREAD || mode&OTRUNC != 0 {
+			return nil, ErrPermissionDenied
+		}
+		return &multiRootFile{f}, nil
+	}
+	file, err := tree.Open(treePath, mode)
+	if err != nil {
+		return nil, err
+	}
+	return multiFile{file, f.numbers[treeName(path)]}, nil
+}
+
+func (f *multiFilesystem) CreateDir(path string, perm uint32) error {
+	tree, treePath, err := f.lookupChild(path)
+	if err != nil {
+		return err
+	}
+	return tree.CreateDir(treePath, perm)
+}
+
+func (f *multiFilesystem) CreateFile(path string, perm uint32) error {
+	tree, treePath, err := f.lookupChild(path)
+	if err != nil {
+		return err
+	}
+	return tree.CreateFile(treePath, perm)
+}
+
+func (f *multiFilesystem) ReadDir(path string) ([]Stat, error) {
+	tree, treePath, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if tree != nil {
+		stats, err := tree.ReadDir(treePath)
+		if err != nil {
+			return nil, err
+		}
+		number := f.numbers[treeName(path)]
+		for i := range stats {
+			stats[i].Qid = treeQid(stats[i].Qid, number)
+		}
+		return stats, nil
+	}
+	names := make([]string, 0, len(f.trees))
+	for name := range f.trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]Stat, 0, len(names))
+	for _, name := range names {
+		stat, err := f.trees[name].Stat("/")
+		if err != nil {
+			return nil, err
+		}
+		stat.Name = name
+		stat.Qid = treeQid(stat.Qid, f.numbers[name])
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (f *multiFilesystem) Remove(path string) error {
+	tree, treePath, err := f.lookupChild(path)
+	if err != nil {
+		return err
+	}
+	return tree.Remove(treePath)
+}
+
+func (f *multiFilesystem) Stat(path string) (Stat, error) {
+	tree, treePath, err := f.lookup(path)
+	if err != nil {
+		return Stat{}, err
+	}
+	if tree == nil {
+		return f.rootStat(), nil
+	}
+	stat, err := tree.Stat(treePath)
+	if err != nil {
+		return Stat{}, err
+	}
+	if treePath == "/" {
+		stat.Name = p.Base(p.Clean("/" + path))
+	}
+	stat.Qid = treeQid(stat.Qid, f.numbers[treeName(path)])
+	return stat, nil
+}
+
+func (f *multiFilesystem) Readlink(path string) (string, error) {
+	tree, treePath, err := f.lookup(path)
+	if err != nil {
+		return "", err
+	}
+	if tree == nil {
+		return "", ErrIOError
+	}
+	return readlink(tree, treePath)
+}
+
+func (f *multiFilesystem) Wstat(path string, stat Stat) error {
+	tree, treePath, err := f.lookupChild(path)
+	if err != nil {
+		return err
+	}
+	return tree.Wstat(treePath, stat)
+}
+
+func (f *multiFilesystem) SetMuid(path string, uname string) {
+	tree, treePath, err := f.lookup(path)
+	if err != nil || tree == nil {
+		return
+	}
+	if setter, ok := tree.(MuidSetter); ok {
+		setter.SetMuid(treePath, uname)
+	}
+}
+
+// lookup returns the tree path is in and the path within it, or a nil tree for
+// the root.
+func (f *multiFilesystem) lookup(path string) (Filesystem, string, error) {
+	path = p.Clean("/" + path)
+	if path == "/" {
+		return nil, "", nil
+	}
+	name, treePath, _ := strings.Cut(path[1:], "/")
+	tree, ok := f.trees[name]
+	if !ok {
+		return nil, "", ErrDoesNotExist
+	}
+	return tree, "/" + treePath, nil
+}
+
+// lookupChild is lookup for operations which would change the root or the
+// root directory of a tree, which are not allowed.
+func (f *multiFilesystem) lookupChild(path string) (Filesystem, string, error) {
+	if p.Dir(p.Clean("/"+path)) == "/" {
+		return nil, "", ErrPermissionDenied
+	}
+	return f.lookup(path)
+}
+
+// treeName returns the name of the tree path is in, or the empty string for the
+// root.
+func treeName(path string) string {
+	name, _, _ := strings.Cut(p.Clean("/" + path)[1:], "/")
+	return name
+}
+
+// treeQid returns qid of a file of the tree with the given number with the
+// qid path it has in the multiFilesystem.
+func treeQid(qid Qid, number uint64) Qid {
+	qid.Path = qid.Path&^treeQidMask | number<<treeQidShift
+	return qid
+}
+
+func (f *multiFilesystem) rootStat() Stat {
+	return Stat{
+		Dev:   f.dev,
+		Qid:   Qid{QTDIR, 0, 0},
+		Mode:  DMDIR | 0555,
+		Name:  "/",
+		Uid:   "?",
+		Gid:   "?",
+		Muid:  "",
+		Atime: uint32(f.clock.Now().Unix()),
+		Mtime: uint32(f.startTime.Unix()),
+	}
+}
+
+func (f multiFile) Qid() Qid {
+	return treeQid(f.File.Qid(), f.number)
+}
+
+func (f multiFile) Stat() (Stat, error) {
+	stat, err := f.File.Stat()
+	stat.Qid = treeQid(stat.Qid, f.number)
+	return stat, err
+}
+
+func (f *multiRootFile) Qid() Qid {
+	return f.fs.rootStat().Qid
+}
+
+func (f *multiRootFile) IsDir() bool {
+	return true
+}
+
+func (f *multiRootFile) Stat() (Stat, error) {
+	return f.fs.rootStat(), nil
+}
+
+func (f *multiRootFile) Read(offset uint64, count uint32) ([]byte, error) {
+	return nil, ErrIOError
+}
+
+func (f *multiRootFile) Write(offset uint64, data []byte) error {
+	return ErrPermissionDenied
+}
+
+func (f *multiRootFile) Sync() error {
+	return nil
+}
+
+func (f *multiRootFile) Close() {
+}
@@ -0,0 +1,92 @@
+package ninep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMultiFilesystem(t *testing.T) {
+	a := NewMemFilesystem()
+	writeMemFile(t, a, "/file", "from a")
+	b := NewMemFilesystem()
+	writeMemFile(t, b, "/file", "from b")
+	fs := NewMultiFilesystem(map[string]Filesystem{"a": a, "b": b})
+
+	c := newTestClient(t, fs)
+	c.attach(0)
+	stats := c.readDir(1)
+	if len(stats) != 4 || stats[2].Name != "a" || stats[3].Name != "b" || stats[2].Mode&DMDIR == 0 {
+		t.Errorf("got %+v, want '.', '..', and the directories 'a' and 'b'", stats)
+	}
+	err := c.rpc(&Tcreate{Tag: 1, Fid: 0, Name: "c", Perm: DMDIR | 0755, Mode: OREAD}, &Rcreate{})
+	if err != rerror(EPermissionDeniedStr) {
+		t.Errorf("got %v, want %v", err, EPermissionDeniedStr)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 2, Nwname: []string{name, "file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Topen{Tag: 1, Fid: 2, Mode: OREAD}, &Ropen{}); err != nil {
+			t.Fatal(err)
+		}
+		var rread Rread
+		if err := c.rpc(&Tread{Tag: 1, Fid: 2, Count: 64}, &rread); err != nil {
+			t.Fatal(err)
+		}
+		if string(rread.Data) != "from "+name {
+			t.Errorf("got '%s', want '%s'", rread.Data, "from "+name)
+		}
+		if err := c.rpc(&Tclunk{Tag: 1, Fid: 2}, &Rclunk{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c = newTestClient(t, fs)
+	c.attachTree(0, "b")
+	var rwalk Rwalk
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"..", "file"}}, &rwalk); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := fs.Stat("/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rwalk.Nwqid[1] != stat.Qid {
+		t.Errorf("got %v, want the qid %v of the file in tree b", rwalk.Nwqid[1], stat.Qid)
+	}
+
+	// The trees number their files alike, but no two files share a qid path.
+	seen := make(map[uint64]string)
+	for _, path := range []string{"/", "/a", "/a/file", "/b", "/b/file"} {
+		stat, err := fs.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := seen[stat.Qid.Path]; ok {
+			t.Errorf("got qid path %d for %s and %s, want distinct ones", stat.Qid.Path, other, path)
+		}
+		seen[stat.Qid.Path] = path
+	}
+	stats, err = fs.ReadDir("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := fs.Stat("/a/file"); stats[0].Qid != stat.Qid {
+		t.Errorf("got %v, want %v", stats[0].Qid, stat.Qid)
+	}
+}
+
+func TestMultiFilesystemClock(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	fs := NewMultiFilesystem(map[string]Filesystem{"a": NewMemFilesystem()}, WithMultiClock(clock))
+	clock.advance(time.Hour)
+	stat, err := fs.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mtime != uint32(start.Unix()) || stat.Atime != uint32(clock.Now().Unix()) {
+		t.Errorf("got mtime %d and atime %d, want %d and %d", stat.Mtime, stat.Atime, start.Unix(), clock.Now().Unix())
+	}
+}
@@ -0,0 +1,80 @@
+package ninep
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+type pipeConn struct {
+	r io.Reader
+	w io.Writer
+}
+
+type pipeAddr struct{}
+
+// NewPipeConn returns a net.Conn reading from r and writing to w, such as the
+// standard input and output of a process started by inetd or ssh. Deadlines are
+// supported when r and w support them.
+func NewPipeConn(r io.Reader, w io.Writer) net.Conn {
+	return &pipeConn{r, w}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *pipeConn) Close() error {
+	var err error
+	if closer, ok := c.r.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if closer, ok := c.w.(io.Closer); ok {
+		if werr := closer.Close(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "pipe"
+}
@@ -0,0 +1,32 @@
+package ninep
+
+import (
+	"io"
+	"testing"
+)
+
+func TestServePipeConn(t *testing.T) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	server := NewServer(nil, NewMemFilesystem(), false)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeConn(NewPipeConn(stdinReader, stdoutWriter))
+	}()
+
+	c := &testClient{t, NewPipeConn(stdoutReader, stdinWriter)}
+	c.attach(0)
+	var rstat Rstat
+	err := c.rpc(&Tstat{Tag: 2, Fid: 0}, &rstat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Name != "/" {
+		t.Errorf("got '%s', want '%s'", rstat.Stat.Name, "/")
+	}
+
+	_ = stdinWriter.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,184 @@
+package ninep
+
+import (
+	"encoding/json"
+	p "path"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+type procFilesystem struct {
+	dev       uint32
+	startTime time.Time
+}
+
+// procFile is an open file of a procFilesystem. Its content is generated when
+// it is opened, so reads at different offsets see the same snapshot.
+type procFile struct {
+	fs    *procFilesystem
+	index int
+	data  []byte
+}
+
+var procEntries = []struct {
+	name     string
+	generate func() ([]byte, error)
+}{
+	{"gc", generateGCStats},
+	{"goroutines", generateGoroutines},
+	{"memstats", generateMemStats},
+}
+
+// NewProcFilesystem returns a read-only filesystem presenting the state of the
+// Go runtime of the server.
+func NewProcFilesystem() Filesystem {
+	return &procFilesystem{newSyntheticDev(), time.Now()}
+}
+
+func (f *procFilesystem) Open(path string, mode uint8) (File, error) {
+	index, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 {
+		return &procFile{f, index, nil}, nil
+	}
+	if mode&3 != OREAD || mode&OTRUNC != 0 {
+		return nil, ErrPermissionDenied
+	}
+	data, err := procEntries[index].generate()
+	if err != nil {
+		return nil, ErrIOError
+	}
+	return &procFile{f, index, data}, nil
+}
+
+func (f *procFilesystem) CreateDir(path string, perm uint32) error {
+	return ErrPermissionDenied
+}
+
+func (f *procFilesystem) CreateFile(path string, perm uint32) error {
+	return ErrPermissionDenied
+}
+
+func (f *procFilesystem) ReadDir(path string) ([]Stat, error) {
+	index, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if index >= 0 {
+		return nil, ErrIOError
+	}
+	stats := make([]Stat, len(procEntries))
+	for i := range procEntries {
+		stats[i] = f.stat(i)
+	}
+	return stats, nil
+}
+
+func (f *procFilesystem) Remove(path string) error {
+	return ErrPermissionDenied
+}
+
+func (f *procFilesystem) Stat(path string) (Stat, error) {
+	index, err := f.lookup(path)
+	if err != nil {
+		return Stat{}, err
+	}
+	return f.stat(index), nil
+}
+
+func (f *procFilesystem) Wstat(path string, stat Stat) error {
+	return ErrPermissionDenied
+}
+
+// lookup returns the index of the entry at path in procEntries, or -1 for the
+// root directory.
+func (f *procFilesystem) lookup(path string) (int, error) {
+	path = p.Clean("/" + path)
+	if path == "/" {
+		return -1, nil
+	}
+	for i, entry := range procEntries {
+		if path == "/"+entry.name {
+			return i, nil
+		}
+	}
+	return 0, ErrDoesNotExist
+}
+
+func (f *procFilesystem) stat(index int) Stat {
+	now := uint32(time.Now().Unix())
+	stat := Stat{
+		Dev:   f.dev,
+		Uid:   "?",
+		Gid:   "?",
+		Muid:  "",
+		Atime: now,
+		Mtime: now,
+	}
+	if index < 0 {
+		stat.Qid = Qid{QTDIR, 0, 0}
+		stat.Mode = DMDIR | 0555
+		stat.Name = "/"
+		stat.Mtime = uint32(f.startTime.Unix())
+	} else {
+		stat.Qid = Qid{QTFILE, 0, uint64(index + 1)}
+		stat.Mode = 0444
+		stat.Name = procEntries[index].name
+	}
+	return stat
+}
+
+func (f *procFile) Qid() Qid {
+	return f.fs.stat(f.index).Qid
+}
+
+func (f *procFile) IsDir() bool {
+	return f.index < 0
+}
+
+func (f *procFile) Stat() (Stat, error) {
+	stat := f.fs.stat(f.index)
+	stat.Length = uint64(len(f.data))
+	return stat, nil
+}
+
+func (f *procFile) Read(offset uint64, count uint32) ([]byte, error) {
+	return sliceAt(f.data, offset, count), nil
+}
+
+func (f *procFile) Write(offset uint64, data []byte) error {
+	return ErrPermissionDenied
+}
+
+func (f *procFile) Sync() error {
+	return nil
+}
+
+func (f *procFile) Close() {
+}
+
+func generateGCStats() ([]byte, error) {
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+	return json.MarshalIndent(stats, "", "\t")
+}
+
+func generateGoroutines() ([]byte, error) {
+	buffer := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			return buffer[:n], nil
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+}
+
+func generateMemStats() ([]byte, error) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return json.MarshalIndent(stats, "", "\t")
+}
@@ -0,0 +1,53 @@
+package ninep
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+)
+
+func TestProcFilesystemMemStats(t *testing.T) {
+	fs := NewProcFilesystem()
+	stats, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, stat := range stats {
+		names[stat.Name] = true
+	}
+	for _, name := range []string{"goroutines", "memstats", "gc"} {
+		if !names[name] {
+			t.Errorf("missing /%s", name)
+		}
+	}
+
+	file, err := fs.Open("/memstats", OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var data []byte
+	for {
+		b, err := file.Read(uint64(len(data)), 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) == 0 {
+			break
+		}
+		data = append(data, b...)
+	}
+	var memStats runtime.MemStats
+	err = json.Unmarshal(data, &memStats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memStats.Sys == 0 || memStats.HeapAlloc == 0 {
+		t.Errorf("got %+v, want non-zero Sys and HeapAlloc", memStats)
+	}
+
+	if _, err := fs.Open("/memstats", ORDWR); err != ErrPermissionDenied {
+		t.Errorf("got %v, want %v", err, ErrPermissionDenied)
+	}
+}
@@ -0,0 +1,83 @@
+package ninep
+
+import (
+	"container/list"
+	"strings"
+)
+
+// DefaultQidCacheSize is the number of path to qid path mappings a local
+// filesystem remembers by default.
+const DefaultQidCacheSize = 1 << 20
+
+// qidCache is a size-bounded map from paths to qid paths evicting the least
+// recently used entries. A path seen again after its entry was evicted gets a
+// new qid path.
+type qidCache struct {
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type qidCacheEntry struct {
+	path    string
+	qidPath uint64
+}
+
+func newQidCache(capacity int) *qidCache {
+	return &qidCache{capacity, list.New(), make(map[string]*list.Element)}
+}
+
+func (c *qidCache) get(path string) (uint64, bool) {
+	e, ok := c.entries[path]
+	if !ok {
+		return 0, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*qidCacheEntry).qidPath, true
+}
+
+func (c *qidCache) put(path string, qidPath uint64) {
+	if e, ok := c.entries[path]; ok {
+		e.Value.(*qidCacheEntry).qidPath = qidPath
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[path] = c.order.PushFront(&qidCacheEntry{path, qidPath})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*qidCacheEntry).path)
+	}
+}
+
+// rename moves the entries of oldPath and of the paths below it to newPath,
+// and reports whether there were any.
+func (c *qidCache) rename(oldPath string, newPath string) bool {
+	var moved []*qidCacheEntry
+	for path, e := range c.entries {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			moved = append(moved, e.Value.(*qidCacheEntry))
+		}
+	}
+	for _, entry := range moved {
+		c.order.Remove(c.entries[entry.path])
+		delete(c.entries, entry.path)
+	}
+	for _, entry := range moved {
+		c.put(newPath+entry.path[len(oldPath):], entry.qidPath)
+	}
+	return len(moved) != 0
+}
+
+func (c *qidCache) len() int {
+	return c.order.Len()
+}
+
+// snapshot returns all entries, the most recently used last.
+func (c *qidCache) snapshot() []qidCacheEntry {
+	entries := make([]qidCacheEntry, 0, c.order.Len())
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		entries = append(entries, *e.Value.(*qidCacheEntry))
+	}
+	return entries
+}
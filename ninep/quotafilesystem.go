@@ -0,0 +1,285 @@
+package ninep
+
+import (
+	p "path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned when a user would store more bytes than the
+// quota of a filesystem made by NewQuotaFilesystem allows.
+var ErrQuotaExceeded = &NineError{Msg: "disk quota exceeded", Errno: errnoEDQUOT}
+
+// quotaFilesystem charges the bytes files grow by to the users making them
+// grow, and refuses to let a user hold more than their quota.
+type quotaFilesystem struct {
+	inner Filesystem
+	quota func(uname string) int64
+
+	mutex sync.Mutex
+	used  map[string]int64
+	// charges holds, for every file, how many of its bytes are charged to
+	// each user.
+	charges map[string]map[string]int64
+}
+
+// quotaUserFilesystem is a quotaFilesystem operated on by one user.
+type quotaUserFilesystem struct {
+	*quotaFilesystem
+	uname string
+}
+
+type quotaFile struct {
+	File
+	fs    *quotaFilesystem
+	path  string
+	uname string
+}
+
+// NewQuotaFilesystem returns a filesystem which limits the bytes each user
+// stores in inner to quota(uname), or leaves them unlimited when it is
+// negative. Only the changes made through the returned filesystem are counted.
+func NewQuotaFilesystem(inner Filesystem, quota func(uname string) int64) Filesystem {
+	return &quotaFilesystem{inner: inner, quota: quota, used: make(map[string]int64), charges: make(map[string]map[string]int64)}
+}
+
+func (f *quotaFilesystem) ForUser(uname string) Filesystem {
+	return quotaUserFilesystem{f, uname}
+}
+
+func (f *quotaFilesystem) Open(path string, mode uint8) (File, error) {
+	return f.open(path, mode, "")
+}
+
+func (f *quotaFilesystem) CreateDir(path string, perm uint32) error {
+	return f.inner.CreateDir(path, perm)
+}
+
+func (f *quotaFilesystem) CreateFile(path string, perm uint32) error {
+	return f.inner.CreateFile(path, perm)
+}
+
+func (f *quotaFilesystem) ReadDir(path string) ([]Stat, error) {
+	return f.inner.ReadDir(path)
+}
+
+func (f *quotaFilesystem) Remove(path string) error {
+	err := f.inner.Remove(path)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.creditLocked(p.Clean("/"+path), -1)
+	return nil
+}
+
+func (f *quotaFilesystem) Stat(path string) (Stat, error) {
+	return f.inner.Stat(path)
+}
+
+func (f *quotaFilesystem) Wstat(path string, stat Stat) error {
+	return f.wstat(path, stat, "")
+}
+
+func (f *quotaFilesystem) Readlink(path string) (string, error) {
+	return readlink(f.inner, path)
+}
+
+func (f *quotaFilesystem) SetMuid(path string, uname string) {
+	if setter, ok := f.inner.(MuidSetter); ok {
+		setter.SetMuid(path, uname)
+	}
+}
+
+func (f *quotaFilesystem) open(path string, mode uint8, uname string) (File, error) {
+	file, err := f.inner.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	path = p.Clean("/" + path)
+	if mode&OTRUNC != 0 {
+		f.mutex.Lock()
+		f.creditLocked(path, -1)
+		f.mutex.Unlock()
+	}
+	return quotaFile{file, f, path, uname}, nil
+}
+
+func (f *quotaFilesystem) wstat(path string, stat Stat, uname string) error {
+	err := f.wstatLength(path, stat, uname)
+	if err != nil || stat.Name == "" {
+		return err
+	}
+	path = p.Clean("/" + path)
+	f.rename(path, p.Join(p.Dir(path), stat.Name))
+	return nil
+}
+
+// wstatLength is wstat charging uname for the growth of the file to the length
+// in stat.
+func (f *quotaFilesystem) wstatLength(path string, stat Stat, uname string) error {
+	if stat.Length == ^uint64(0) {
+		return f.inner.Wstat(path, stat)
+	}
+	old, err := f.inner.Stat(path)
+	if err != nil {
+		return err
+	}
+	path = p.Clean("/" + path)
+	if stat.Length < old.Length {
+		err = f.inner.Wstat(path, stat)
+		if err != nil {
+			return err
+		}
+		return f.resize(path, uname, int64(old.Length), int64(stat.Length))
+	}
+	err = f.resize(path, uname, int64(old.Length), int64(stat.Length))
+	if err != nil {
+		return err
+	}
+	err = f.inner.Wstat(path, stat)
+	if err != nil {
+		f.reconcile(path, int64(stat.Length), int64(old.Length))
+		return err
+	}
+	return nil
+}
+
+// resize charges uname for the growth of path from oldSize to newSize, or
+// credits back the bytes it shrinks by.
+func (f *quotaFilesystem) resize(path string, uname string, oldSize int64, newSize int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if newSize <= oldSize {
+		f.creditLocked(path, oldSize-newSize)
+		return nil
+	}
+	growth := newSize - oldSize
+	limit := f.quota(uname)
+	if limit >= 0 && f.used[uname]+growth > limit {
+		return ErrQuotaExceeded
+	}
+	f.used[uname] += growth
+	if f.charges[path] == nil {
+		f.charges[path] = make(map[string]int64)
+	}
+	f.charges[path][uname] += growth
+	return nil
+}
+
+// rename moves the charges for oldPath and the files below it to newPath.
+func (f *quotaFilesystem) rename(oldPath string, newPath string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for path, charges := range f.charges {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			delete(f.charges, path)
+			f.charges[newPath+path[len(oldPath):]] = charges
+		}
+	}
+}
+
+// reconcile credits back the bytes charged for path growing to chargedSize
+// when it only grew to actualSize.
+func (f *quotaFilesystem) reconcile(path string, chargedSize int64, actualSize int64) {
+	if actualSize >= chargedSize {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.creditLocked(path, chargedSize-actualSize)
+}
+
+// creditLocked takes bytes charged for path back from the users they are
+// charged to, or all of them if bytes is negative.
+func (f *quotaFilesystem) creditLocked(path string, bytes int64) {
+	charges := f.charges[path]
+	unames := make([]string, 0, len(charges))
+	for uname := range charges {
+		unames = append(unames, uname)
+	}
+	sort.Strings(unames)
+	for _, uname := range unames {
+		credit := charges[uname]
+		if bytes >= 0 {
+			credit = min(credit, bytes)
+			bytes -= credit
+		}
+		f.used[uname] -= credit
+		charges[uname] -= credit
+		if charges[uname] == 0 {
+			delete(charges, uname)
+		}
+	}
+	if len(charges) == 0 {
+		delete(f.charges, path)
+	}
+}
+
+// usedBy returns the number of bytes charged to uname.
+func (f *quotaFilesystem) usedBy(uname string) int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.used[uname]
+}
+
+func (f quotaUserFilesystem) Open(path string, mode uint8) (File, error) {
+	return f.open(path, mode, f.uname)
+}
+
+func (f quotaUserFilesystem) CreateDir(path string, perm uint32) error {
+	err := f.checkQuota()
+	if err != nil {
+		return err
+	}
+	return f.inner.CreateDir(path, perm)
+}
+
+func (f quotaUserFilesystem) CreateFile(path string, perm uint32) error {
+	err := f.checkQuota()
+	if err != nil {
+		return err
+	}
+	return f.inner.CreateFile(path, perm)
+}
+
+func (f quotaUserFilesystem) Wstat(path string, stat Stat) error {
+	return f.wstat(path, stat, f.uname)
+}
+
+// checkQuota fails if the user has used up their quota.
+func (f quotaUserFilesystem) checkQuota() error {
+	limit := f.quota(f.uname)
+	if limit >= 0 && f.usedBy(f.uname) >= limit {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (f quotaFile) Write(offset uint64, data []byte) error {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	oldSize := int64(stat.Length)
+	newSize := int64(offset) + int64(len(data))
+	if stat.Mode&DMAPPEND != 0 {
+		newSize = oldSize + int64(len(data))
+	}
+	if newSize < oldSize {
+		newSize = oldSize
+	}
+	err = f.fs.resize(f.path, f.uname, oldSize, newSize)
+	if err != nil {
+		return err
+	}
+	writeErr := f.File.Write(offset, data)
+	if writeErr != nil {
+		if stat, err := f.File.Stat(); err == nil {
+			f.fs.reconcile(f.path, newSize, int64(stat.Length))
+		}
+	}
+	return writeErr
+}
@@ -0,0 +1,70 @@
+package ninep
+
+import (
+	"testing"
+)
+
+func TestQuotaFilesystem(t *testing.T) {
+	quota := func(uname string) int64 {
+		if uname == "glenda" {
+			return 8
+		}
+		return -1
+	}
+	c := newTestClient(t, NewQuotaFilesystem(NewMemFilesystem(), quota))
+	c.version()
+	if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "glenda"}, &Rattach{}); err != nil {
+		t.Fatal(err)
+	}
+	create := func(fid uint32, name string) error {
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: fid, Nwname: []string{}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		return c.rpc(&Tcreate{Tag: 1, Fid: fid, Name: name, Perm: 0644, Mode: ORDWR}, &Rcreate{})
+	}
+	write := func(fid uint32, offset uint64, data string) error {
+		return c.rpc(&Twrite{Tag: 1, Fid: fid, Offset: offset, Data: []byte(data)}, &Rwrite{})
+	}
+	if err := create(1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(1, 0, "12345"); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting does not grow the file, so it costs nothing.
+	if err := write(1, 0, "54321"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(1, 5, "6789"); err != rerror(ErrQuotaExceeded.Msg) {
+		t.Errorf("got %v, want %v", err, ErrQuotaExceeded.Msg)
+	}
+	if err := write(1, 5, "678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 1}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := create(2, "b"); err != rerror(ErrQuotaExceeded.Msg) {
+		t.Errorf("got %v, want %v", err, ErrQuotaExceeded.Msg)
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 2}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 3, Nwname: []string{"a"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	// The bytes stay charged to the file under its new name.
+	rename := Stat{Stype: ^uint16(0), Dev: ^uint32(0), Qid: Qid{^uint8(0), ^uint32(0), ^uint64(0)}, Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0), Name: "c"}
+	if err := c.rpc(&Twstat{Tag: 1, Fid: 3, Stat: rename}, &Rwstat{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tremove{Tag: 1, Fid: 3}, &Rremove{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := create(2, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(2, 0, "12345678"); err != nil {
+		t.Errorf("got %v, want the write to succeed after the remove", err)
+	}
+}
@@ -0,0 +1,135 @@
+package ninep
+
+import (
+	"sync"
+)
+
+// Call is an operation done on a RecordingFilesystem or on one of its files.
+// The methods of files are named File.Read, File.Write and so on, and take
+// the path of the file as their first argument.
+type Call struct {
+	Method  string
+	Args    []any
+	Results []any
+}
+
+// RecordingFilesystem is a Filesystem which records the operations done on it
+// before passing them on to another one.
+type RecordingFilesystem struct {
+	inner Filesystem
+
+	mutex sync.Mutex
+	calls []Call
+}
+
+type recordingFile struct {
+	File
+	fs   *RecordingFilesystem
+	path string
+}
+
+// NewRecordingFilesystem returns a filesystem recording the operations done on
+// inner through it.
+func NewRecordingFilesystem(inner Filesystem) *RecordingFilesystem {
+	return &RecordingFilesystem{inner: inner}
+}
+
+// Calls returns the operations recorded so far, in the order they were done.
+func (f *RecordingFilesystem) Calls() []Call {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+func (f *RecordingFilesystem) record(method string, args []any, results ...any) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = append(f.calls, Call{method, args, results})
+}
+
+func (f *RecordingFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.inner.Open(path, mode)
+	f.record("Open", []any{path, mode}, err)
+	if err != nil {
+		return nil, err
+	}
+	return recordingFile{file, f, path}, nil
+}
+
+func (f *RecordingFilesystem) CreateDir(path string, perm uint32) error {
+	err := f.inner.CreateDir(path, perm)
+	f.record("CreateDir", []any{path, perm}, err)
+	return err
+}
+
+func (f *RecordingFilesystem) CreateFile(path string, perm uint32) error {
+	err := f.inner.CreateFile(path, perm)
+	f.record("CreateFile", []any{path, perm}, err)
+	return err
+}
+
+func (f *RecordingFilesystem) ReadDir(path string) ([]Stat, error) {
+	stats, err := f.inner.ReadDir(path)
+	f.record("ReadDir", []any{path}, stats, err)
+	return stats, err
+}
+
+func (f *RecordingFilesystem) Remove(path string) error {
+	err := f.inner.Remove(path)
+	f.record("Remove", []any{path}, err)
+	return err
+}
+
+func (f *RecordingFilesystem) Stat(path string) (Stat, error) {
+	stat, err := f.inner.Stat(path)
+	f.record("Stat", []any{path}, stat, err)
+	return stat, err
+}
+
+func (f *RecordingFilesystem) Wstat(path string, stat Stat) error {
+	err := f.inner.Wstat(path, stat)
+	f.record("Wstat", []any{path, stat}, err)
+	return err
+}
+
+func (f *RecordingFilesystem) Readlink(path string) (string, error) {
+	target, err := readlink(f.inner, path)
+	f.record("Readlink", []any{path}, target, err)
+	return target, err
+}
+
+func (f *RecordingFilesystem) SetMuid(path string, uname string) {
+	if setter, ok := f.inner.(MuidSetter); ok {
+		setter.SetMuid(path, uname)
+		f.record("SetMuid", []any{path, uname})
+	}
+}
+
+func (f recordingFile) Stat() (Stat, error) {
+	stat, err := f.File.Stat()
+	f.fs.record("File.Stat", []any{f.path}, stat, err)
+	return stat, err
+}
+
+func (f recordingFile) Read(offset uint64, count uint32) ([]byte, error) {
+	data, err := f.File.Read(offset, count)
+	f.fs.record("File.Read", []any{f.path, offset, count}, data, err)
+	return data, err
+}
+
+func (f recordingFile) Write(offset uint64, data []byte) error {
+	err := f.File.Write(offset, data)
+	f.fs.record("File.Write", []any{f.path, offset, data}, err)
+	return err
+}
+
+func (f recordingFile) Sync() error {
+	err := f.File.Sync()
+	f.fs.record("File.Sync", []any{f.path}, err)
+	return err
+}
+
+func (f recordingFile) Close() {
+	f.File.Close()
+	f.fs.record("File.Close", []any{f.path})
+}
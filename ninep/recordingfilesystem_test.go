@@ -0,0 +1,46 @@
+package ninep
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecordingFilesystem(t *testing.T) {
+	inner := NewMemFilesystem()
+	writeMemFile(t, inner, "/file", "hello")
+	fs := NewRecordingFilesystem(inner)
+	c := newTestClient(t, fs)
+	c.attach(0)
+	attached := len(fs.Calls())
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+	var got []Call
+	for _, call := range fs.Calls()[attached:] {
+		// Only the methods and arguments are compared.
+		got = append(got, Call{Method: call.Method, Args: call.Args})
+	}
+	// Statting an unopened fid does not open its file, and statting an
+	// opened one uses its file.
+	want := []Call{
+		{"Stat", []any{"/file"}, nil},
+		{"Stat", []any{"/file"}, nil},
+		{"Open", []any{"/file", uint8(OREAD)}, nil},
+		{"File.Stat", []any{"/file"}, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if stat, ok := fs.Calls()[attached].Results[0].(Stat); !ok || stat.Name != "file" {
+		t.Errorf("got results %v, want the stat of file", fs.Calls()[attached].Results)
+	}
+}
@@ -0,0 +1,332 @@
+// Package ninep implements a 9P2000 file server that can serve any Filesystem.
+package ninep
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrServerClosed = errors.New("server closed")
+var errTooManySessions = errors.New("too many sessions")
+
+type Server struct {
+	listener           net.Listener
+	filesystem         Filesystem
+	sessionFilesystem  func(Filesystem) Filesystem
+	debug              bool
+	errorMapper        func(error) string
+	auth               Authenticator
+	authorizer         Authorizer
+	validateFid        bool
+	disabledMessages   map[uint8]bool
+	tracer             Tracer
+	framer             Framer
+	maxDirEntries      int
+	maxDirListingBytes int
+	clock              Clock
+	idleTimeout        time.Duration
+	handshakeTimeout   time.Duration
+	slowThreshold      time.Duration
+	orderedReplies     bool
+	maxSessions        int
+	batchDelay         time.Duration
+	nameNormalizer     func(string) string
+	protocolVersion    string
+	syncPolicy         SyncPolicy
+
+	mutex        sync.Mutex
+	shuttingDown bool
+	sessions     map[*session]struct{}
+	sessionsWg   sync.WaitGroup
+}
+
+type ServerOption func(*Server)
+
+// WithErrorMapper installs a function choosing the Rerror text sent for an
+// error returned while handling a request. Returning the empty string keeps the
+// default text.
+func WithErrorMapper(mapper func(error) string) ServerOption {
+	return func(s *Server) {
+		s.errorMapper = mapper
+	}
+}
+
+// WithAuthenticator requires clients to authenticate with a before attaching.
+func WithAuthenticator(a Authenticator) ServerOption {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithAuthorizer lets a decide whether each attach is allowed.
+func WithAuthorizer(a Authorizer) ServerOption {
+	return func(s *Server) {
+		s.authorizer = a
+	}
+}
+
+// WithFidValidation makes the server check before each operation that the file
+// a fid refers to still has the qid it had when the fid was walked to it, so
+// clients re-walk fids whose file was replaced behind their back.
+func WithFidValidation() ServerOption {
+	return func(s *Server) {
+		s.validateFid = true
+	}
+}
+
+// WithSessionFilesystem gives every session the filesystem returned by wrap
+// for the filesystem of the server, for example NewCowFilesystem to let each
+// client make changes which are discarded when it disconnects.
+func WithSessionFilesystem(wrap func(Filesystem) Filesystem) ServerOption {
+	return func(s *Server) {
+		s.sessionFilesystem = wrap
+	}
+}
+
+// WithDisabledMessages makes the server reply to the T-messages of the given
+// types, e.g. TwriteType, with an error instead of handling them, whatever
+// the filesystem would allow.
+func WithDisabledMessages(mtypes ...uint8) ServerOption {
+	return func(s *Server) {
+		if s.disabledMessages == nil {
+			s.disabledMessages = make(map[uint8]bool)
+		}
+		for _, mtype := range mtypes {
+			s.disabledMessages[mtype] = true
+		}
+	}
+}
+
+// WithMaxDirEntries limits the number of entries listed for a directory, not
+// counting "." and "..". Entries beyond max are left out of the listing.
+// Filesystems which are LimitedDirReaders, such as local ones, stop reading
+// the directory at max entries and choose which ones are left, local ones
+// keep those the host lists first. Other filesystems still read it whole and
+// keep the first max entries of their listing, so the limit only bounds the
+// listing held for the client.
+func WithMaxDirEntries(max int) ServerOption {
+	return func(s *Server) {
+		s.maxDirEntries = max
+	}
+}
+
+// WithMaxDirListingBytes limits the memory each session uses to hold the
+// listings of the directories its clients read to about max bytes,
+// DefaultMaxDirListingBytes by default. The least recently read listings are
+// dropped first.
+func WithMaxDirListingBytes(max int) ServerOption {
+	return func(s *Server) {
+		s.maxDirListingBytes = max
+	}
+}
+
+// WithClock makes the server tell the time with clock instead of the time
+// package.
+func WithClock(clock Clock) ServerOption {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
+// WithIdleTimeout closes connections which sent no message for timeout, after
+// answering the requests still being handled.
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithHandshakeTimeout closes connections which did not negotiate a version
+// within timeout of connecting or of their last message, instead of applying
+// the idle timeout to them.
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.handshakeTimeout = timeout
+	}
+}
+
+// WithSlowRequestLog logs a warning for every request taking longer than
+// threshold to handle, with its type, fid and the path of the fid, whether
+// debugging is enabled or not.
+func WithSlowRequestLog(threshold time.Duration) ServerOption {
+	return func(s *Server) {
+		s.slowThreshold = threshold
+	}
+}
+
+// WithOrderedReplies makes the server answer requests in the order they were
+// received. By default requests are answered as soon as they are handled,
+// which 9P allows since replies carry the tags of their requests, but some
+// clients expect the replies in order. The replies to the requests following
+// a slow one are held back until it is answered.
+func WithOrderedReplies() ServerOption {
+	return func(s *Server) {
+		s.orderedReplies = true
+	}
+}
+
+// WithMaxSessions limits the number of sessions served at once to max.
+// Connections accepted while max sessions are running are closed right away.
+func WithMaxSessions(max int) ServerOption {
+	return func(s *Server) {
+		s.maxSessions = max
+	}
+}
+
+// WithWriteBatching buffers the replies to pipelined requests, writing them
+// together when no request is left to answer or once delay has passed since
+// the first of them was buffered, whichever comes first.
+func WithWriteBatching(delay time.Duration) ServerOption {
+	return func(s *Server) {
+		s.batchDelay = delay
+	}
+}
+
+// WithProtocolVersion makes the server accept only version, which should be
+// one IsSupportedVersion reports, instead of every supported version.
+func WithProtocolVersion(version string) ServerOption {
+	return func(s *Server) {
+		s.protocolVersion = version
+	}
+}
+
+// WithNameNormalization brings the file names clients walk to and create to
+// the Unicode normalization form, so that names typed on systems preferring
+// different forms, like NFD on macOS and NFC on Linux, refer to the same file.
+func WithNameNormalization(form norm.Form) ServerOption {
+	return func(s *Server) {
+		s.nameNormalizer = form.String
+	}
+}
+
+// SyncPolicy is when the server syncs the files clients write to.
+type SyncPolicy int
+
+const (
+	// SyncOnClunk syncs files opened for writing when their fid is clunked.
+	SyncOnClunk SyncPolicy = iota
+	// SyncAlways syncs a file after every write, before replying to it.
+	SyncAlways
+	// SyncNever leaves syncing to the filesystem.
+	SyncNever
+)
+
+// WithSyncPolicy sets when files are synced, SyncOnClunk by default.
+func WithSyncPolicy(policy SyncPolicy) ServerOption {
+	return func(s *Server) {
+		s.syncPolicy = policy
+	}
+}
+
+func NewServer(l net.Listener, f Filesystem, debug bool, opts ...ServerOption) *Server {
+	s := &Server{listener: l, filesystem: f, debug: debug, framer: sizePrefixFramer{}, maxDirListingBytes: DefaultMaxDirListingBytes, clock: realClock{}, sessions: make(map[*session]struct{})}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Server) AcceptLoop() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			log.Println(err)
+			continue
+		}
+		session := newSession(s, conn)
+		err = s.addSession(session)
+		if err == errTooManySessions {
+			log.Printf("refusing connection from %s: %v\n", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			continue
+		}
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		go session.loop()
+	}
+}
+
+// ServeConn runs a single session on conn and returns when it ends.
+func (s *Server) ServeConn(conn net.Conn) error {
+	session := newSession(s, conn)
+	err := s.addSession(session)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	session.loop()
+	return nil
+}
+
+// Shutdown stops accepting new connections and lets every session finish the
+// request it is currently handling. Sessions still running when ctx is done are
+// closed forcibly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shuttingDown = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for session := range s.sessions {
+		_ = session.conn.SetReadDeadline(time.Now())
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionsWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mutex.Lock()
+		for session := range s.sessions {
+			_ = session.conn.Close()
+		}
+		s.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shuttingDown
+}
+
+func (s *Server) addSession(session *session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown {
+		return ErrServerClosed
+	}
+	if s.maxSessions > 0 && len(s.sessions) >= s.maxSessions {
+		return errTooManySessions
+	}
+	s.sessions[session] = struct{}{}
+	s.sessionsWg.Add(1)
+	return nil
+}
+
+func (s *Server) removeSession(session *session) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.sessions[session]; ok {
+		delete(s.sessions, session)
+		s.sessionsWg.Done()
+	}
+}
@@ -0,0 +1,1496 @@
+package ninep
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	p "path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MaximumMsgSize = 8 * 1024
+	// MinimumMsgSize is the smallest msize the server negotiates, leaving room
+	// for a Tread or Twrite header and at least one byte of data.
+	MinimumMsgSize = IOHDRSZ + 1
+
+	ENoAuthRequiredStr        = "no authentication required"
+	EIOErrorStr               = "i/o error"
+	ENoSuchFileOrDirectoryStr = "file does not exist"
+	EBadMessageStr            = "protocol botch"
+	EAlreadyExistsStr         = "file or directory already exists"
+	EDirNotEmptyStr           = "directory is not empty"
+	EAuthFailedStr            = "authentication failed"
+	EPermissionDeniedStr      = "permission denied"
+	ENotDirectoryStr          = "not a directory"
+	ESymlinkLoopStr           = "symbolic link loop"
+	EStaleFidStr              = "fid no longer valid"
+	EEmptyNameStr             = "empty name"
+	EBadNameStr               = "bad character in file name"
+	EFidInUseStr              = "fid already in use"
+	ENotPermittedStr          = "operation not permitted"
+	ENotSupportedStr          = "operation not supported"
+	ECountTooSmallStr         = "count too small"
+	ECrossDeviceStr           = "cannot rename across devices"
+	EFidOpenStr               = "cannot walk from an open fid"
+	EFidAlreadyOpenStr        = "fid already open"
+	EUnknownUserStr           = "unknown user or group"
+	EFidNotOpenStr            = "fid not open for i/o"
+	EWrongModeStr             = "fid not open for that operation"
+	EStaleSnapshotStr         = "file changed since the snapshot"
+	ENoSpaceStr               = "no space left on device"
+	EAmbiguousNameStr         = "name matches several files"
+	EDirChangedStr            = "directory changed, read it again from offset 0"
+)
+
+var ErrInvalidFid = errors.New("invalid fid")
+var ErrUnexpectedMessage = errors.New("expected different message type")
+var ErrStaleFid = errors.New("fid no longer valid")
+var ErrEmptyName = errors.New("empty name")
+var ErrBadName = errors.New("bad character in file name")
+var ErrFidInUse = errors.New("fid already in use")
+var ErrOperationNotPermitted = errors.New("operation not permitted")
+var ErrNotSupported = errors.New("operation not supported")
+var ErrCountTooSmall = errors.New("count too small")
+var ErrFidOpen = errors.New("cannot walk from an open fid")
+var ErrFidAlreadyOpen = errors.New("fid already open")
+var ErrFidNotOpen = errors.New("fid not open for i/o")
+var ErrWrongMode = errors.New("fid not open for that operation")
+var ErrDirChanged = errors.New("directory changed, read it again from offset 0")
+
+// unsupportedCreatePerm are the type bits of a Tcreate perm naming kinds of
+// files other than directories and regular files, which cannot be created.
+// Symbolic links need the target carried by the extension of a 9P2000.u
+// Tcreate, and the server does not speak that dialect.
+const unsupportedCreatePerm = DMMOUNT | DMAUTH | DMSYMLINK | DMDEVICE | DMNAMEDPIPE | DMSOCKET
+
+type session struct {
+	server          *Server
+	conn            net.Conn
+	connectedAt     time.Time
+	filesystem      Filesystem
+	reader          *bufio.Reader
+	receivedVersion bool
+	dialect         string
+	maxsize         uint32
+	idle            atomic.Bool
+
+	// Messages are handled concurrently once the version is negotiated, and
+	// answered as they complete unless replies are ordered. handlers tracks
+	// them, and inFlight maps their tags to channels closed when they are
+	// answered, for Tflush to wait on. turns maps them to their place in the
+	// order of replies, lastTurn being the one of the last request received.
+	handlers     sync.WaitGroup
+	failOnce     sync.Once
+	handlerErr   error
+	sendMutex    sync.Mutex
+	inFlightLock sync.Mutex
+	inFlight     map[uint16]chan struct{}
+	turns        map[uint16]*replyTurn
+	lastTurn     chan struct{}
+
+	// writer buffers replies when write batching is on, they are flushed
+	// when no other request is being handled or by flushTimer.
+	writer       *bufio.Writer
+	flushTimer   Timer
+	flushPending bool
+
+	fidsMutex sync.Mutex
+	fids      map[uint32]fidEntry
+	// fidSerial is the serial of the last fid entry set.
+	fidSerial uint64
+	// dirListings holds the serialized entries of the open directories,
+	// taken when they are read at offset 0.
+	dirListings *dirListingCache
+}
+
+// errTagInUse is returned for requests reusing the tag of a request still
+// waiting for its turn to be answered.
+var errTagInUse = errors.New("tag of a request in flight reused")
+
+// replyTurn is the place of the reply to a request in the order of replies. It
+// is sent once prev is closed, after the reply to the previous request.
+type replyTurn struct {
+	prev <-chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// fidEntry is the state of a fid. root is the directory the fid was attached
+// to, walks never leave it. uname is the user who attached it.
+type fidEntry struct {
+	root  string
+	uname string
+	path  string
+	qid   Qid
+	file  File
+	mode  uint8
+	auth  *authEntry
+	// users counts the requests using file, which is only closed once
+	// they are done.
+	users *sync.WaitGroup
+	// serial tells the entries set for a fid apart, it is 0 for no entry.
+	serial uint64
+}
+
+// authEntry is the state of an afid.
+type authEntry struct {
+	uname string
+	aname string
+	auth  Auth
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	filesystem := server.filesystem
+	if server.sessionFilesystem != nil {
+		filesystem = server.sessionFilesystem(filesystem)
+	}
+	s := &session{server: server, conn: conn, connectedAt: server.clock.Now(), filesystem: filesystem, reader: bufio.NewReader(conn), inFlight: make(map[uint16]chan struct{}), turns: make(map[uint16]*replyTurn), fids: make(map[uint32]fidEntry), dirListings: newDirListingCache(server.maxDirListingBytes)}
+	if server.batchDelay > 0 {
+		s.writer = bufio.NewWriter(conn)
+	}
+	return s
+}
+
+func (s *session) loop() {
+	log.Printf("accepted new connection: %s\n", s.conn.RemoteAddr())
+	var err error
+	var idleTimer Timer
+	resetIdleTimer := func() {
+		timeout := s.idleTimeout()
+		switch {
+		case timeout <= 0:
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+		case idleTimer == nil:
+			idleTimer = s.server.clock.AfterFunc(timeout, s.closeIdle)
+		default:
+			idleTimer.Reset(timeout)
+		}
+	}
+	resetIdleTimer()
+	for {
+		var msg interface{}
+		var frame []byte
+		frame, err = s.server.framer.ReadFrame(s.reader)
+		if err != nil {
+			goto end
+		}
+		resetIdleTimer()
+		msg, err = unmarshalMessage(frame)
+		if err == nil && !isRequest(msg) {
+			err = errNotRequest
+		}
+		if err == errBadStat && isRequest(msg) {
+			// The frame around the stat is sound, so only the request is
+			// refused, before the stat is used.
+			err = s.sendError(msg.(message).tag(), EBadMessageStr)
+			if err != nil {
+				goto end
+			}
+			continue
+		}
+		if err != nil {
+			err = &protocolError{err}
+			goto end
+		}
+		if s.server.debug {
+			log.Printf("<- %s %+v\n", messageName(msg), msg)
+		}
+		if !s.receivedVersion {
+			err = s.handleNextMsg(msg)
+			if err != nil {
+				goto end
+			}
+			if s.receivedVersion {
+				resetIdleTimer()
+			}
+			continue
+		}
+		err = s.handleConcurrently(msg)
+		if err != nil {
+			err = &protocolError{err}
+			goto end
+		}
+	}
+end:
+	if idleTimer != nil {
+		idleTimer.Stop()
+	}
+	// Requests still being handled are answered before the connection is
+	// closed, also when the client only closed its side of it.
+	s.handlers.Wait()
+	if s.writer != nil {
+		s.sendMutex.Lock()
+		flushErr := s.flushLocked()
+		s.sendMutex.Unlock()
+		if flushErr != nil {
+			s.fail(flushErr)
+		}
+	}
+	// Wait for a failure of a concurrent flushBatch to be recorded.
+	s.failOnce.Do(func() {})
+	if s.handlerErr != nil {
+		err = s.handlerErr
+	}
+	s.clean()
+	if s.idle.Load() {
+		log.Printf("closing idle connection: %s\n", s.conn.RemoteAddr())
+	} else if !errors.Is(err, io.EOF) && !s.server.isShuttingDown() {
+		log.Println(err)
+	}
+	log.Printf("connection closed: %s reason=%s\n", s.conn.RemoteAddr(), s.endReason(err))
+	_ = s.conn.Close()
+	s.server.removeSession(s)
+}
+
+// protocolError is an error decoding a message sent by the client.
+type protocolError struct {
+	err error
+}
+
+func (e *protocolError) Error() string {
+	return "bad message: " + e.err.Error()
+}
+
+// endReason classifies why the session ended with err for logging: eof when
+// the client disconnected, protocol_error when it broke the protocol, timeout
+// when it was idle for too long, server_shutdown when the server shut down and
+// io_error for failures of the connection or of the filesystem.
+func (s *session) endReason(err error) string {
+	var protoErr *protocolError
+	switch {
+	case s.idle.Load():
+		return "timeout"
+	case s.server.isShuttingDown():
+		return "server_shutdown"
+	case errors.As(err, &protoErr), errors.Is(err, errFrameTooShort), errors.Is(err, ErrUnexpectedMessage):
+		return "protocol_error"
+	case errors.Is(err, io.EOF):
+		return "eof"
+	default:
+		return "io_error"
+	}
+}
+
+// authorize asks the authorizer, if it authorizes operations, whether the
+// user of fid may do the operation of type mtype on path.
+func (s *session) authorize(fid fidEntry, mtype uint8, path string) error {
+	authorizer, ok := s.server.authorizer.(OperationAuthorizer)
+	if !ok {
+		return nil
+	}
+	err := authorizer.AuthorizeOperation(s.connInfo(), fid.uname, mtype, path)
+	if err != nil {
+		log.Printf("operation %d on %s as %q rejected: %v\n", mtype, path, fid.uname, err)
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// checkEnabled fails with ErrOperationNotPermitted if any of the message types
+// was disabled, also for the messages of 9P2000.e doing their work.
+func (s *session) checkEnabled(mtypes ...uint8) error {
+	for _, mtype := range mtypes {
+		if s.server.disabledMessages[mtype] {
+			return ErrOperationNotPermitted
+		}
+	}
+	return nil
+}
+
+// connInfo describes the connection of the session. The TLS handshake is done
+// by the first read, so the state of a TLS connection is complete once a
+// message was received.
+func (s *session) connInfo() ConnInfo {
+	info := ConnInfo{RemoteAddr: s.conn.RemoteAddr(), ConnectedAt: s.connectedAt}
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+	}
+	return info
+}
+
+// idleTimeout is how long the connection may go without sending a message,
+// which is the handshake timeout until a version was negotiated.
+func (s *session) idleTimeout() time.Duration {
+	if !s.receivedVersion && s.server.handshakeTimeout > 0 {
+		return s.server.handshakeTimeout
+	}
+	return s.server.idleTimeout
+}
+
+// closeIdle stops reading from a connection which sent no message for the idle
+// timeout, like Server.Shutdown does.
+func (s *session) closeIdle() {
+	s.idle.Store(true)
+	_ = s.conn.SetReadDeadline(time.Now())
+}
+
+// handleConcurrently handles msg in a goroutine of its own. An error replying
+// to it ends the session. If replies are ordered, msg must not reuse the tag of
+// a request whose reply was not sent yet, which would take its turn.
+func (s *session) handleConcurrently(msg interface{}) error {
+	tag := msg.(message).tag()
+	done := make(chan struct{})
+	var turn *replyTurn
+	s.inFlightLock.Lock()
+	if s.server.orderedReplies {
+		if _, ok := s.turns[tag]; ok {
+			s.inFlightLock.Unlock()
+			return errTagInUse
+		}
+		turn = &replyTurn{prev: s.lastTurn, done: make(chan struct{})}
+		s.lastTurn = turn.done
+	}
+	s.inFlight[tag] = done
+	if turn != nil {
+		s.turns[tag] = turn
+	}
+	s.inFlightLock.Unlock()
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+		err := s.handleNextMsg(msg)
+		s.inFlightLock.Lock()
+		if s.inFlight[tag] == done {
+			delete(s.inFlight, tag)
+		}
+		if turn != nil && s.turns[tag] == turn {
+			delete(s.turns, tag)
+		}
+		s.inFlightLock.Unlock()
+		if turn != nil {
+			// Let the replies after it go, also if none was sent.
+			turn.end()
+		}
+		close(done)
+		if err != nil {
+			s.fail(err)
+		}
+	}()
+	return nil
+}
+
+// waitTurn waits until the reply to the request with the given tag may be
+// sent, if replies are ordered, and returns a function to call once it was.
+// The turn is forgotten first, so that the tag may be reused once the client
+// has the reply.
+func (s *session) waitTurn(tag uint16) func() {
+	s.inFlightLock.Lock()
+	turn := s.turns[tag]
+	delete(s.turns, tag)
+	s.inFlightLock.Unlock()
+	if turn == nil {
+		return func() {}
+	}
+	if turn.prev != nil {
+		<-turn.prev
+	}
+	return turn.end
+}
+
+func (t *replyTurn) end() {
+	t.once.Do(func() {
+		close(t.done)
+	})
+}
+
+// fail ends the session after an error replying to a client, unless it has
+// failed already.
+func (s *session) fail(err error) {
+	s.failOnce.Do(func() {
+		s.handlerErr = err
+		_ = s.conn.Close()
+	})
+}
+
+func (s *session) clean() {
+	s.fidsMutex.Lock()
+	defer s.fidsMutex.Unlock()
+	for _, f := range s.fids {
+		_ = s.closeFile(f)
+	}
+}
+
+// closeFile closes the file of fid, if it is open, after syncing it if the
+// sync policy asks for it.
+func (s *session) closeFile(fid fidEntry) error {
+	if fid.file == nil {
+		return nil
+	}
+	fid.waitUnused()
+	defer fid.file.Close()
+	if s.server.syncPolicy == SyncOnClunk && (fid.mode&3 == OWRITE || fid.mode&3 == ORDWR) {
+		return fid.file.Sync()
+	}
+	return nil
+}
+
+func (s *session) send(v interface{}) error {
+	if s.server.debug {
+		log.Printf("-> %s %+v\n", messageName(v), v)
+	}
+	b := getBuffer()
+	defer putBuffer(b)
+	err := marshalMessage(b, v)
+	if err != nil {
+		return err
+	}
+	return s.sendFrame(b.Bytes())
+}
+
+// sendFrame writes a marshaled message to the client.
+func (s *session) sendFrame(frame []byte) error {
+	// The tag follows the type.
+	defer s.waitTurn(binary.LittleEndian.Uint16(frame[1:]))()
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if s.writer == nil {
+		return s.server.framer.WriteFrame(s.conn, frame)
+	}
+	err := s.server.framer.WriteFrame(s.writer, frame)
+	if err != nil {
+		return err
+	}
+	// The reply being sent is the last one owed to the client, nothing
+	// else would be written with it.
+	if s.outstanding() <= 1 {
+		return s.flushLocked()
+	}
+	if !s.flushPending {
+		s.flushPending = true
+		if s.flushTimer == nil {
+			s.flushTimer = s.server.clock.AfterFunc(s.server.batchDelay, s.flushBatch)
+		} else {
+			s.flushTimer.Reset(s.server.batchDelay)
+		}
+	}
+	return nil
+}
+
+// outstanding returns the number of requests being handled.
+func (s *session) outstanding() int {
+	s.inFlightLock.Lock()
+	defer s.inFlightLock.Unlock()
+	return len(s.inFlight)
+}
+
+// flushBatch writes the buffered replies once the batching delay has passed.
+func (s *session) flushBatch() {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if !s.flushPending {
+		return
+	}
+	err := s.flushLocked()
+	if err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *session) flushLocked() error {
+	if s.flushPending {
+		s.flushPending = false
+		s.flushTimer.Stop()
+	}
+	return s.writer.Flush()
+}
+
+func (s *session) sendError(tag uint16, name string) error {
+	return s.send(&Rerror{Tag: tag, Ename: name})
+}
+
+func (s *session) getFid(fid uint32) (fidEntry, error) {
+	s.fidsMutex.Lock()
+	f, ok := s.fids[fid]
+	s.fidsMutex.Unlock()
+	if !ok {
+		return fidEntry{}, ErrInvalidFid
+	}
+	return f, nil
+}
+
+// useFid is getFid for operations using the open file of fid. The file is not
+// closed, e.g. by a concurrent clunk, before done is called.
+func (s *session) useFid(fid uint32) (f fidEntry, done func(), err error) {
+	s.fidsMutex.Lock()
+	defer s.fidsMutex.Unlock()
+	f, ok := s.fids[fid]
+	if !ok {
+		return fidEntry{}, nil, ErrInvalidFid
+	}
+	if f.users == nil {
+		return f, func() {}, nil
+	}
+	f.users.Add(1)
+	return f, f.users.Done, nil
+}
+
+// waitUnused waits until no request uses the open file of f. The entry must
+// have been removed from the fids, so that no new request starts using it.
+func (f fidEntry) waitUnused() {
+	if f.users != nil {
+		f.users.Wait()
+	}
+}
+
+// getFileFid is getFid for operations which are not valid on an afid.
+func (s *session) getFileFid(fid uint32) (fidEntry, error) {
+	f, err := s.getFid(fid)
+	if err != nil {
+		return fidEntry{}, err
+	}
+	if f.auth != nil {
+		return fidEntry{}, ErrInvalidFid
+	}
+	return f, s.validateFid(f)
+}
+
+// validateFid checks that the file of a fid has not been replaced, if enabled.
+func (s *session) validateFid(f fidEntry) error {
+	if !s.server.validateFid {
+		return nil
+	}
+	stat, err := s.filesystemFor(f.uname).Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if stat.Qid.Path != f.qid.Path || stat.Qid.Ftype != f.qid.Ftype {
+		return ErrStaleFid
+	}
+	return nil
+}
+
+// replaceFid sets the entry of fid if its current one is still old, or if fid
+// is still unused when old is the zero entry, and reports whether it did.
+// Requests doing slow work between reading a fid and setting it use it, so
+// that they do not undo a concurrent change such as a clunk.
+func (s *session) replaceFid(fid uint32, old fidEntry, entry fidEntry) bool {
+	s.fidsMutex.Lock()
+	defer s.fidsMutex.Unlock()
+	if s.fids[fid].serial != old.serial {
+		return false
+	}
+	s.fidSerial++
+	entry.serial = s.fidSerial
+	s.fids[fid] = entry
+	s.dirListings.remove(fid)
+	return true
+}
+
+func (s *session) fidInUse(fid uint32) bool {
+	s.fidsMutex.Lock()
+	defer s.fidsMutex.Unlock()
+	_, ok := s.fids[fid]
+	return ok
+}
+
+// takeFid removes fid and returns its entry, so that only one of concurrent
+// requests removing the same fid gets it.
+func (s *session) takeFid(fid uint32) (fidEntry, error) {
+	s.fidsMutex.Lock()
+	defer s.fidsMutex.Unlock()
+	f, ok := s.fids[fid]
+	if !ok {
+		return fidEntry{}, ErrInvalidFid
+	}
+	delete(s.fids, fid)
+	s.dirListings.remove(fid)
+	return f, nil
+}
+
+func (s *session) handleNextMsg(msg interface{}) error {
+	span := s.startSpan(msg)
+	defer span.End()
+	if s.server.slowThreshold > 0 {
+		// The fid is described first, as the request may clunk it.
+		defer s.logIfSlow(msg, s.describeFid(msg), s.server.clock.Now())
+	}
+	err := s.dispatch(msg)
+	if err == nil {
+		return nil
+	}
+	span.RecordError(err)
+	return s.sendHandlerError(msg, err)
+}
+
+// logIfSlow warns about msg, whose fid is described by fid, if handling it took
+// longer than the slow request threshold since start.
+func (s *session) logIfSlow(msg interface{}, fid string, start time.Time) {
+	elapsed := s.server.clock.Now().Sub(start)
+	if elapsed > s.server.slowThreshold {
+		log.Printf("warning: slow request: %s%s took %v\n", messageName(msg), fid, elapsed)
+	}
+}
+
+// describeFid returns the fid of msg and its path for logging, or the empty
+// string if msg has no fid.
+func (s *session) describeFid(msg interface{}) string {
+	fid, ok := messageFid(msg)
+	if !ok {
+		return ""
+	}
+	f, err := s.getFid(fid)
+	if err != nil || f.auth != nil {
+		return fmt.Sprintf(" fid %d", fid)
+	}
+	return fmt.Sprintf(" fid %d path %s", fid, f.path)
+}
+
+// dispatch handles msg, returning the errors which have to be reported to the
+// client.
+func (s *session) dispatch(msg interface{}) error {
+	if !s.receivedVersion {
+		m, ok := msg.(*Tversion)
+		if !ok {
+			return ErrUnexpectedMessage
+		}
+		return s.handleVersion(m)
+	}
+	err := s.checkEnabled(getMessageType(msg))
+	if err != nil {
+		return err
+	}
+	switch m := msg.(type) {
+	case *Tauth:
+		err = s.handleAuth(m)
+	case *Tattach:
+		err = s.handleAttach(m)
+	case *Tclunk:
+		err = s.handleClunk(m)
+	case *Tcreate:
+		err = s.handleCreate(m)
+	case *Tflush:
+		err = s.handleFlush(m)
+	case *Topen:
+		err = s.handleOpen(m)
+	case *Tread:
+		err = s.handleRead(m)
+	case *Tremove:
+		err = s.handleRemove(m)
+	case *Tstat:
+		err = s.handleStat(m)
+	case *Tversion:
+		err = ErrUnexpectedMessage
+	case *Twalk:
+		err = s.handleWalk(m)
+	case *Twrite:
+		err = s.handleWrite(m)
+	case *Twstat:
+		err = s.handleWstat(m)
+	case *Tsession:
+		err = s.handleSession(m)
+	case *Tsread:
+		err = s.handleSread(m)
+	case *Tswrite:
+		err = s.handleSwrite(m)
+	}
+	return err
+}
+
+// sendHandlerError replies to msg with the Rerror for err, returned by its
+// handler. Errors without an Rerror are returned to end the session.
+func (s *session) sendHandlerError(msg interface{}, err error) error {
+	tag := msg.(message).tag()
+	if s.server.errorMapper != nil {
+		if ename := s.server.errorMapper(err); ename != "" {
+			return s.sendError(tag, ename)
+		}
+	}
+	nineErr := toNineError(err)
+	if nineErr == nil {
+		return err
+	}
+	return s.sendError(tag, nineErr.Msg)
+}
+
+// toNineError returns the NineError err is or wraps, or the one corresponding
+// to err if it is one of the errors of this package. It returns nil for other
+// errors, which end the session.
+func toNineError(err error) *NineError {
+	var nineErr *NineError
+	if errors.As(err, &nineErr) {
+		return nineErr
+	}
+	switch err {
+	case ErrIOError:
+		return &NineError{EIOErrorStr, errnoEIO}
+	case ErrDoesNotExist:
+		return &NineError{ENoSuchFileOrDirectoryStr, errnoENOENT}
+	case ErrInvalidFid:
+		return &NineError{EBadMessageStr, errnoEBADF}
+	case ErrAlreadyExists:
+		return &NineError{EAlreadyExistsStr, errnoEEXIST}
+	case ErrDirectoryNotEmpty:
+		return &NineError{EDirNotEmptyStr, errnoENOTEMPTY}
+	case ErrAuthFailed:
+		return &NineError{EAuthFailedStr, errnoEACCES}
+	case ErrPermissionDenied:
+		return &NineError{EPermissionDeniedStr, errnoEACCES}
+	case ErrNotDirectory:
+		return &NineError{ENotDirectoryStr, errnoENOTDIR}
+	case ErrSymlinkLoop:
+		return &NineError{ESymlinkLoopStr, errnoELOOP}
+	case ErrStaleFid:
+		return &NineError{EStaleFidStr, errnoEBADF}
+	case ErrEmptyName:
+		return &NineError{EEmptyNameStr, errnoEINVAL}
+	case ErrBadName:
+		return &NineError{EBadNameStr, errnoEINVAL}
+	case ErrFidInUse:
+		return &NineError{EFidInUseStr, errnoEBADF}
+	case ErrOperationNotPermitted:
+		return &NineError{ENotPermittedStr, errnoEPERM}
+	case ErrNotSupported:
+		return &NineError{ENotSupportedStr, errnoEOPNOTSUPP}
+	case ErrCountTooSmall:
+		return &NineError{ECountTooSmallStr, errnoEINVAL}
+	case ErrCrossDevice:
+		return &NineError{ECrossDeviceStr, errnoEXDEV}
+	case ErrFidOpen:
+		return &NineError{EFidOpenStr, errnoEBADF}
+	case ErrFidAlreadyOpen:
+		return &NineError{EFidAlreadyOpenStr, errnoEBADF}
+	case ErrDirChanged:
+		return &NineError{EDirChangedStr, errnoEINVAL}
+	case ErrUnknownUser:
+		return &NineError{EUnknownUserStr, errnoEINVAL}
+	case ErrAmbiguousName:
+		return &NineError{EAmbiguousNameStr, errnoEINVAL}
+	case ErrNoSpace:
+		return &NineError{ENoSpaceStr, errnoENOSPC}
+	case ErrStaleSnapshot:
+		return &NineError{EStaleSnapshotStr, errnoESTALE}
+	case ErrFidNotOpen:
+		return &NineError{EFidNotOpenStr, errnoEBADF}
+	case ErrWrongMode:
+		return &NineError{EWrongModeStr, errnoEBADF}
+	default:
+		return nil
+	}
+}
+
+func (s *session) handleAuth(m *Tauth) error {
+	if s.server.auth == nil {
+		return s.sendError(m.Tag, ENoAuthRequiredStr)
+	}
+	if s.fidInUse(m.Afid) {
+		return ErrFidInUse
+	}
+	auth, err := s.server.auth.Start(m.Uname, m.Aname)
+	if err != nil {
+		return err
+	}
+	if !s.replaceFid(m.Afid, fidEntry{}, fidEntry{auth: &authEntry{m.Uname, m.Aname, auth}}) {
+		return ErrFidInUse
+	}
+	return s.send(&Rauth{Tag: m.Tag, Aqid: Qid{Ftype: QTAUTH}})
+}
+
+func (s *session) handleAttach(m *Tattach) error {
+	if m.Fid == NOFID {
+		return ErrInvalidFid
+	}
+	if s.fidInUse(m.Fid) {
+		return ErrFidInUse
+	}
+	if s.server.auth != nil {
+		afid, err := s.getFid(m.Afid)
+		if err != nil || afid.auth == nil {
+			return ErrAuthFailed
+		}
+		if afid.auth.uname != m.Uname || afid.auth.aname != m.Aname || !afid.auth.auth.Authenticated() {
+			return ErrAuthFailed
+		}
+	} else if m.Afid != NOFID {
+		return s.sendError(m.Tag, ENoAuthRequiredStr)
+	}
+	if s.server.authorizer != nil {
+		err := s.server.authorizer.Authorize(s.connInfo(), m.Uname, m.Aname)
+		if err != nil {
+			log.Printf("attach of %q as %q from %s rejected: %v\n", m.Aname, m.Uname, s.conn.RemoteAddr(), err)
+			return ErrPermissionDenied
+		}
+	}
+	root := p.Clean("/" + m.Aname)
+	stat, err := s.filesystemFor(m.Uname).Stat(root)
+	if err != nil {
+		return err
+	}
+	if !s.replaceFid(m.Fid, fidEntry{}, fidEntry{root: root, uname: m.Uname, path: root, qid: stat.Qid}) {
+		return ErrFidInUse
+	}
+	return s.send(&Rattach{Tag: m.Tag, Qid: stat.Qid})
+}
+
+func (s *session) handleClunk(m *Tclunk) error {
+	// The fid is gone before Rclunk is sent, so the client can reuse it as
+	// soon as it receives the reply.
+	f, err := s.takeFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	err = s.closeFile(f)
+	if err != nil {
+		return err
+	}
+	return s.send(&Rclunk{Tag: m.Tag})
+}
+
+func (s *session) handleCreate(m *Tcreate) error {
+	isDir := (m.Perm & DMDIR) == DMDIR
+	fid, err := s.getFileFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	if fid.file != nil {
+		return ErrFidAlreadyOpen
+	}
+	err = validateName(m.Name)
+	if err != nil {
+		return err
+	}
+	if m.Name == "." || m.Name == ".." {
+		return ErrBadName
+	}
+	if m.Perm&unsupportedCreatePerm != 0 {
+		return ErrNotSupported
+	}
+	fullPath := walkPath(fid.root, fid.path, s.normalizeName(m.Name))
+	err = s.authorize(fid, TcreateType, fullPath)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		err = s.filesystemFor(fid.uname).CreateDir(fullPath, m.Perm)
+	} else {
+		err = s.filesystemFor(fid.uname).CreateFile(fullPath, m.Perm)
+	}
+	if err != nil {
+		return err
+	}
+	// Directories can only be opened for reading.
+	mode := m.Mode
+	if isDir {
+		mode = OREAD
+	}
+	f, err := s.filesystemFor(fid.uname).Open(fullPath, mode)
+	if err != nil {
+		return err
+	}
+	if !s.replaceFid(m.Fid, fid, fidEntry{root: fid.root, uname: fid.uname, path: fullPath, qid: f.Qid(), file: f, mode: mode, users: new(sync.WaitGroup)}) {
+		f.Close()
+		return ErrInvalidFid
+	}
+	s.setMuid(fullPath, fid.uname)
+	return s.send(&Rcreate{Tag: m.Tag, Qid: f.Qid(), Iouint: s.iounit()})
+}
+
+// handleFlush waits for the message being flushed to be answered, since
+// handlers cannot be interrupted, so Rflush always comes after its reply.
+func (s *session) handleFlush(m *Tflush) error {
+	s.inFlightLock.Lock()
+	done, ok := s.inFlight[m.Oldtag]
+	s.inFlightLock.Unlock()
+	if ok && m.Oldtag != m.Tag {
+		<-done
+	}
+	return s.send(&Rflush{Tag: m.Tag})
+}
+
+func (s *session) handleOpen(m *Topen) error {
+	fid, err := s.getFileFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	if fid.file != nil {
+		return ErrFidAlreadyOpen
+	}
+	err = s.authorize(fid, TopenType, fid.path)
+	if err != nil {
+		return err
+	}
+	file, err := s.filesystemFor(fid.uname).Open(fid.path, m.Mode)
+	if err != nil {
+		return err
+	}
+	opened := fid
+	opened.file = file
+	opened.mode = m.Mode
+	opened.users = new(sync.WaitGroup)
+	opened.qid = file.Qid()
+	if !s.replaceFid(m.Fid, fid, opened) {
+		file.Close()
+		return ErrInvalidFid
+	}
+	return s.send(&Ropen{Tag: m.Tag, Qid: file.Qid(), Iouint: s.iounit()})
+}
+
+func (s *session) handleRead(m *Tread) error {
+	fid, done, err := s.useFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	defer done()
+	// Counts above the iounit are clamped rather than rejected, so the Rread
+	// always fits in msize.
+	m.Count = min(m.Count, s.iounit())
+	if fid.auth != nil {
+		b, err := fid.auth.auth.Read(m.Count)
+		if err != nil {
+			return err
+		}
+		if err := checkReadCount(m.Count, b); err != nil {
+			return err
+		}
+		return s.send(&Rread{Tag: m.Tag, Data: b})
+	}
+	if fid.file == nil {
+		return ErrFidNotOpen
+	}
+	if fid.mode&3 == OWRITE {
+		return ErrWrongMode
+	}
+	err = s.validateFid(fid)
+	if err != nil {
+		return err
+	}
+	if fid.file.IsDir() {
+		return s.handleReadDir(m, fid)
+	} else {
+		return s.handleReadFile(m, fid.file)
+	}
+}
+
+func (s *session) handleReadFile(m *Tread, file File) error {
+	if r, ok := file.(ReaderAtFile); ok && m.Offset <= math.MaxInt64 {
+		return s.sendReadFrom(m, r)
+	}
+	b, err := file.Read(m.Offset, m.Count)
+	if err != nil {
+		return err
+	}
+	if err := checkReadCount(m.Count, b); err != nil {
+		return err
+	}
+	return s.send(&Rread{Tag: m.Tag, Data: b})
+}
+
+// checkReadCount fails reads which returned more data than the clamped count,
+// which would not fit in msize.
+func checkReadCount(count uint32, data []byte) error {
+	if uint64(len(data)) > uint64(count) {
+		log.Printf("read returned %d bytes, more than the %d asked for\n", len(data), count)
+		return ErrIOError
+	}
+	return nil
+}
+
+// sendReadFrom replies to m with an Rread whose data is read from r straight
+// into the marshaled message.
+func (s *session) sendReadFrom(m *Tread, r io.ReaderAt) error {
+	b := getBuffer()
+	defer putBuffer(b)
+	// The count is filled in once the data was read.
+	header := [1 + 2 + 4]byte{RreadType}
+	binary.LittleEndian.PutUint16(header[1:], m.Tag)
+	b.Write(header[:])
+	n, err := io.CopyN(b, io.NewSectionReader(r, int64(m.Offset), int64(m.Count)), int64(m.Count))
+	if err != nil && !errors.Is(err, io.EOF) {
+		if toNineError(err) == nil {
+			log.Println(err)
+			return ErrIOError
+		}
+		return err
+	}
+	frame := b.Bytes()
+	binary.LittleEndian.PutUint32(frame[3:], uint32(n))
+	if s.server.debug {
+		log.Printf("-> Rread %+v\n", &Rread{Tag: m.Tag, Data: frame[len(header):]})
+	}
+	return s.sendFrame(frame)
+}
+
+func (s *session) handleReadDir(m *Tread, fid fidEntry) error {
+	data, err := s.readDir(m, fid)
+	if err != nil {
+		return err
+	}
+	return s.send(&Rread{Tag: m.Tag, Data: data})
+}
+
+// readDir returns the directory entries for m from the listing of fid, which
+// is taken when reading starts so that the client sees a consistent listing.
+// A listing evicted from s.dirListings is taken again, and reading it goes on
+// only if the offset still falls between two of its entries.
+// The offset is a byte offset into the listing in every dialect the server
+// speaks; 9P2000.L, whose offsets are cookies, is not supported.
+func (s *session) readDir(m *Tread, fid fidEntry) ([]byte, error) {
+	listing, ok := s.dirListings.get(m.Fid)
+	if m.Offset == 0 || !ok {
+		var err error
+		listing, err = s.dirListing(fid)
+		if err != nil {
+			return nil, err
+		}
+		s.dirListings.put(m.Fid, listing)
+		if !isEntryBoundary(listing, m.Offset) {
+			return nil, ErrDirChanged
+		}
+	}
+	entries := dirEntriesAt(listing, m.Offset, m.Count)
+	// An empty Rread would tell the client the listing ended.
+	if len(entries) == 0 && m.Offset < uint64(len(listing)) {
+		return nil, ErrCountTooSmall
+	}
+	return entries, nil
+}
+
+// dirListing serializes the entries of the directory of fid, starting with
+// "." and "..".
+func (s *session) dirListing(fid fidEntry) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	dotStat, err := s.filesystemFor(fid.uname).Stat(fid.path)
+	if err != nil {
+		return nil, err
+	}
+	dotStat.Name = "."
+	dotStat.Serialize(buffer)
+	dotDotStat, err := s.filesystemFor(fid.uname).Stat(walkPath(fid.root, fid.path, ".."))
+	if err != nil {
+		return nil, err
+	}
+	dotDotStat.Name = ".."
+	dotDotStat.Serialize(buffer)
+	stats, err := s.listDir(fid)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stats {
+		s.Serialize(buffer)
+	}
+	return buffer.Bytes(), nil
+}
+
+// listDir returns the entries of the directory of fid, at most
+// maxDirEntries of them if it is set.
+func (s *session) listDir(fid fidEntry) ([]Stat, error) {
+	fs := s.filesystemFor(fid.uname)
+	max := s.server.maxDirEntries
+	if max <= 0 {
+		return fs.ReadDir(fid.path)
+	}
+	if reader, ok := fs.(LimitedDirReader); ok {
+		stats, more, err := reader.ReadDirLimit(fid.path, max)
+		if more {
+			log.Printf("listing of %s truncated to %d entries\n", fid.path, max)
+		}
+		return stats, err
+	}
+	stats, err := fs.ReadDir(fid.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) > max {
+		log.Printf("listing of %s truncated to %d of %d entries\n", fid.path, max, len(stats))
+		stats = stats[:max]
+	}
+	return stats, nil
+}
+
+func (s *session) handleRemove(m *Tremove) error {
+	fid, err := s.getFileFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	// Only one of concurrent requests removing the fid gets to close it.
+	fid, err = s.takeFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	if fid.file != nil {
+		fid.waitUnused()
+		fid.file.Close()
+	}
+	err = s.authorize(fid, TremoveType, fid.path)
+	if err != nil {
+		return err
+	}
+	err = s.filesystemFor(fid.uname).Remove(fid.path)
+	if err != nil {
+		return err
+	}
+	return s.send(&Rremove{Tag: m.Tag})
+}
+
+func (s *session) handleStat(m *Tstat) error {
+	fid, done, err := s.useFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if fid.auth != nil {
+		return ErrInvalidFid
+	}
+	err = s.validateFid(fid)
+	if err != nil {
+		return err
+	}
+	var stat Stat
+	if fid.file != nil && !fid.file.IsDir() {
+		// The open file may outlive its path, e.g. after being removed.
+		// Directories are still statted by path, as their open handles
+		// may hold a snapshot taken when they were opened.
+		stat, err = fid.file.Stat()
+	} else {
+		stat, err = s.filesystemFor(fid.uname).Stat(fid.path)
+	}
+	if err != nil {
+		return err
+	}
+	if fid.path == fid.root {
+		stat.Name = "/"
+	}
+	return s.send(&Rstat{Tag: m.Tag, Stat: stat})
+}
+
+// iounit is the largest count of a Tread or Twrite whose message fits in the
+// negotiated msize.
+func (s *session) iounit() uint32 {
+	return s.maxsize - IOHDRSZ
+}
+
+func (s *session) handleVersion(m *Tversion) error {
+	s.maxsize = min(m.Msize, MaximumMsgSize)
+	if s.maxsize < MinimumMsgSize {
+		s.maxsize = MinimumMsgSize
+	}
+	if !IsSupportedVersion(m.Version) || s.server.protocolVersion != "" && m.Version != s.server.protocolVersion {
+		return s.send(&Rversion{Tag: m.Tag, Msize: s.maxsize, Version: "unknown"})
+	}
+	s.receivedVersion = true
+	s.dialect = m.Version
+	return s.send(&Rversion{Tag: m.Tag, Msize: s.maxsize, Version: m.Version})
+}
+
+func (s *session) handleWalk(m *Twalk) error {
+	fid, err := s.getFileFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	if m.Newfid == NOFID {
+		return ErrInvalidFid
+	}
+	// Walking from an open fid is illegal, also to clone it with no names.
+	if fid.file != nil {
+		return ErrFidOpen
+	}
+	if m.Newfid != m.Fid && s.fidInUse(m.Newfid) {
+		return ErrFidInUse
+	}
+	// The new fid must still be unused, or still be the fid walked from.
+	old := fidEntry{}
+	if m.Newfid == m.Fid {
+		old = fid
+	}
+	if len(m.Nwname) == 0 {
+		if !s.replaceFid(m.Newfid, old, fid) {
+			return ErrFidInUse
+		}
+		return s.send(&Rwalk{Tag: m.Tag, Nwqid: []Qid{}})
+	}
+	path, result, err := s.walk(fid, m.Nwname)
+	if err != nil {
+		return err
+	}
+	if !s.replaceFid(m.Newfid, old, fidEntry{root: fid.root, uname: fid.uname, path: path, qid: result[len(result)-1]}) {
+		return ErrFidInUse
+	}
+	return s.send(&Rwalk{Tag: m.Tag, Nwqid: result})
+}
+
+// walk resolves names from the file of fid, returning the path reached and the
+// qids of the files walked through.
+func (s *session) walk(fid fidEntry, names []string) (string, []Qid, error) {
+	for _, name := range names {
+		err := validateName(name)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	path := fid.path
+	result := make([]Qid, len(names))
+	for i, name := range names {
+		path = walkPath(fid.root, path, s.normalizeName(name))
+		stat, err := s.filesystemFor(fid.uname).Stat(path)
+		if err != nil {
+			return "", nil, err
+		}
+		result[i] = stat.Qid
+	}
+	return path, result, nil
+}
+
+// handleSession acknowledges a 9P2000.e Tsession. Sessions are not kept after
+// a client disconnects, so there is nothing to resume.
+func (s *session) handleSession(m *Tsession) error {
+	if s.dialect != ProtocolVersionE {
+		return ErrUnexpectedMessage
+	}
+	return s.send(&Rsession{Tag: m.Tag})
+}
+
+// handleSread reads a whole file in one round trip, as a walk from fid, an
+// open, a read and a clunk would.
+func (s *session) handleSread(m *Tsread) error {
+	if s.dialect != ProtocolVersionE {
+		return ErrUnexpectedMessage
+	}
+	err := s.checkEnabled(TopenType, TreadType)
+	if err != nil {
+		return err
+	}
+	fid, err := s.getFileFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	path, _, err := s.walk(fid, m.Nwname)
+	if err != nil {
+		return err
+	}
+	err = s.authorize(fid, TopenType, path)
+	if err != nil {
+		return err
+	}
+	file, err := s.filesystemFor(fid.uname).Open(path, OREAD)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if file.IsDir() {
+		return ErrIOError
+	}
+	data, err := file.Read(0, s.iounit())
+	if err != nil {
+		return err
+	}
+	if err := checkReadCount(s.iounit(), data); err != nil {
+		return err
+	}
+	return s.send(&Rsread{Tag: m.Tag, Data: data})
+}
+
+// handleSwrite replaces the content of a file in one round trip, as a walk
+// from fid, an open with OTRUNC, a write and a clunk would.
+func (s *session) handleSwrite(m *Tswrite) error {
+	if s.dialect != ProtocolVersionE {
+		return ErrUnexpectedMessage
+	}
+	err := s.checkEnabled(TopenType, TwriteType)
+	if err != nil {
+		return err
+	}
+	fid, err := s.getFileFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	path, _, err := s.walk(fid, m.Nwname)
+	if err != nil {
+		return err
+	}
+	err = s.authorize(fid, TopenType, path)
+	if err != nil {
+		return err
+	}
+	err = s.swrite(fid, path, m.Data)
+	if err != nil {
+		return err
+	}
+	return s.send(&Rswrite{Tag: m.Tag, Count: uint32(len(m.Data))})
+}
+
+// swrite replaces the contents of the file at path with data. The file is
+// closed before the reply, as the clunk ending the write would.
+func (s *session) swrite(fid fidEntry, path string, data []byte) error {
+	file, err := s.filesystemFor(fid.uname).Open(path, OWRITE|OTRUNC)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if file.IsDir() {
+		return ErrIOError
+	}
+	err = file.Write(0, data)
+	if err != nil {
+		return err
+	}
+	s.setMuid(path, fid.uname)
+	// The write is followed by the clunk, so both policies which sync at all
+	// sync here.
+	if s.server.syncPolicy == SyncNever {
+		return nil
+	}
+	return file.Sync()
+}
+
+func (s *session) handleWrite(m *Twrite) error {
+	fid, done, err := s.useFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if fid.auth != nil {
+		err = fid.auth.auth.Write(m.Data)
+		if err != nil {
+			return err
+		}
+		return s.send(&Rwrite{Tag: m.Tag, Count: uint32(len(m.Data))})
+	}
+	if fid.file == nil {
+		return ErrFidNotOpen
+	}
+	if fid.mode&3 != OWRITE && fid.mode&3 != ORDWR {
+		return ErrWrongMode
+	}
+	err = s.validateFid(fid)
+	if err != nil {
+		return err
+	}
+	err = fid.file.Write(m.Offset, m.Data)
+	var partial *PartialWriteError
+	if errors.As(err, &partial) {
+		log.Println(err)
+		s.setMuid(fid.path, fid.uname)
+		return s.send(&Rwrite{Tag: m.Tag, Count: uint32(partial.Written)})
+	}
+	if err != nil {
+		return err
+	}
+	s.setMuid(fid.path, fid.uname)
+	if s.server.syncPolicy == SyncAlways {
+		err = fid.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return s.send(&Rwrite{Tag: m.Tag, Count: uint32(len(m.Data))})
+}
+
+func (s *session) handleWstat(m *Twstat) error {
+	fid, err := s.getFileFid(m.Fid)
+	if err != nil {
+		return err
+	}
+	err = s.authorize(fid, TwstatType, fid.path)
+	if err != nil {
+		return err
+	}
+	// A name other than the current one renames the file within its
+	// directory, which is passed on to the filesystem as the only name change.
+	stat := m.Stat
+	path := fid.path
+	if stat.Name != "" {
+		stat.Name = s.normalizeName(stat.Name)
+		if stat.Name == p.Base(fid.path) {
+			stat.Name = ""
+		} else {
+			err = validateName(stat.Name)
+			if err != nil {
+				return err
+			}
+			if stat.Name == "." || stat.Name == ".." {
+				return ErrBadName
+			}
+			// The file attached to stays where it is.
+			if fid.path == fid.root {
+				return ErrPermissionDenied
+			}
+			path = p.Join(p.Dir(fid.path), stat.Name)
+		}
+	}
+	err = s.filesystemFor(fid.uname).Wstat(fid.path, stat)
+	if err != nil {
+		return err
+	}
+	if path != fid.path {
+		s.renameFids(fid.path, path)
+	}
+	s.setMuid(path, fid.uname)
+	return s.send(&Rwstat{Tag: m.Tag})
+}
+
+// renameFids moves the fids of the session at oldPath or below it to newPath,
+// after the file was renamed.
+func (s *session) renameFids(oldPath string, newPath string) {
+	moved := func(path string) string {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			return newPath + path[len(oldPath):]
+		}
+		return path
+	}
+	s.fidsMutex.Lock()
+	defer s.fidsMutex.Unlock()
+	for n, fid := range s.fids {
+		fid.root = moved(fid.root)
+		fid.path = moved(fid.path)
+		s.fids[n] = fid
+	}
+}
+
+// setMuid records uname as the last user who modified path, if the filesystem
+// keeps track of it.
+func (s *session) setMuid(path string, uname string) {
+	if setter, ok := s.filesystem.(MuidSetter); ok {
+		setter.SetMuid(path, uname)
+	}
+}
+
+// filesystemFor returns the filesystem to operate on for requests of uname.
+func (s *session) filesystemFor(uname string) Filesystem {
+	if f, ok := s.filesystem.(UserFilesystem); ok {
+		return f.ForUser(uname)
+	}
+	return s.filesystem
+}
+
+// normalizeName brings name to the Unicode normalization form the server is
+// configured with, if any.
+func (s *session) normalizeName(name string) string {
+	if s.server.nameNormalizer == nil {
+		return name
+	}
+	return s.server.nameNormalizer(name)
+}
+
+// validateName checks that name is usable as a single path element, so it
+// cannot be used to reach across directories once joined to a path.
+func validateName(name string) error {
+	if name == "" {
+		return ErrEmptyName
+	}
+	if strings.ContainsAny(name, "/\x00") {
+		return ErrBadName
+	}
+	return nil
+}
+
+// walkPath resolves name relative to path without leaving root.
+func walkPath(root string, path string, name string) string {
+	path = p.Join(path, name)
+	if root != "/" && path != root && !strings.HasPrefix(path, root+"/") {
+		return root
+	}
+	return path
+}
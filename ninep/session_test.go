@@ -0,0 +1,2602 @@
+package ninep
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type rerror string
+
+func (e rerror) Error() string {
+	return string(e)
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// testFilesystems returns an empty filesystem of each kind tests run against,
+// by name.
+func testFilesystems(t *testing.T) map[string]Filesystem {
+	return map[string]Filesystem{"local": NewLocalFilesystem(t.TempDir()), "mem": NewMemFilesystem()}
+}
+
+func newTestClient(t *testing.T, fs Filesystem, opts ...ServerOption) *testClient {
+	server := NewServer(nil, fs, false, opts...)
+	clientConn, serverConn := net.Pipe()
+	go newSession(server, serverConn).loop()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+	})
+	return &testClient{t, clientConn}
+}
+
+// rpc sends tmsg and decodes the reply into rmsg. An Rerror reply is returned
+// as an rerror.
+func (c *testClient) rpc(tmsg any, rmsg any) error {
+	frame := new(bytes.Buffer)
+	err := SerializeMessage(frame, tmsg)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(frame.Bytes())
+	if err != nil {
+		return err
+	}
+	msg, err := DeserializeMessage(c.conn)
+	if err != nil {
+		return err
+	}
+	if got, want := msg.(message).tag(), tmsg.(message).tag(); got != want {
+		return fmt.Errorf("got tag %d, want %d", got, want)
+	}
+	if rerr, ok := msg.(*Rerror); ok {
+		return rerror(rerr.Ename)
+	}
+	if reflect.TypeOf(msg) != reflect.TypeOf(rmsg) {
+		return fmt.Errorf("got %T, want %T", msg, rmsg)
+	}
+	reflect.ValueOf(rmsg).Elem().Set(reflect.ValueOf(msg).Elem())
+	return nil
+}
+
+func (c *testClient) attach(fid uint32) Qid {
+	return c.attachTree(fid, "")
+}
+
+func (c *testClient) version() {
+	var rversion Rversion
+	err := c.rpc(&Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: ProtocolVersion}, &rversion)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) attachTree(fid uint32, aname string) Qid {
+	c.version()
+	var rattach Rattach
+	err := c.rpc(&Tattach{Tag: 1, Fid: fid, Afid: ^uint32(0), Uname: "user", Aname: aname}, &rattach)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return rattach.Qid
+}
+
+func TestErrorMapper(t *testing.T) {
+	mapper := func(err error) string {
+		if errors.Is(err, ErrDoesNotExist) {
+			return "No such file or directory"
+		}
+		return ""
+	}
+	fs := NewMemFilesystem()
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, fs, WithErrorMapper(mapper))
+	c.attach(0)
+
+	err := c.rpc(&Twalk{Tag: 2, Fid: 0, Newfid: 1, Nwname: []string{"missing"}}, &Rwalk{})
+	if err != rerror("No such file or directory") {
+		t.Errorf("got %v, want %v", err, "No such file or directory")
+	}
+	err = c.rpc(&Tread{Tag: 3, Fid: 7, Count: 16}, &Rread{})
+	if err != rerror(EBadMessageStr) {
+		t.Errorf("got %v, want %v", err, EBadMessageStr)
+	}
+}
+
+// exceededQuotaFilesystem is a Filesystem whose files cannot be opened because
+// the disk quota is exceeded.
+type exceededQuotaFilesystem struct {
+	Filesystem
+}
+
+func (f exceededQuotaFilesystem) Open(path string, mode uint8) (File, error) {
+	return nil, &NineError{Msg: "disk quota exceeded", Errno: errnoEDQUOT}
+}
+
+func TestNineError(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, exceededQuotaFilesystem{fs})
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{})
+	if err != rerror("disk quota exceeded") {
+		t.Errorf("got %v, want %v", err, "disk quota exceeded")
+	}
+	if got := toNineError(ErrDoesNotExist); got.Msg != ENoSuchFileOrDirectoryStr || got.Errno != errnoENOENT {
+		t.Errorf("got %+v, want %s and %v", got, ENoSuchFileOrDirectoryStr, errnoENOENT)
+	}
+}
+
+func TestAttachSubtree(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	if err := fs.CreateDir("/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("/sub/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, fs)
+	rootQid := c.attachTree(0, "sub")
+
+	var rstat Rstat
+	err := c.rpc(&Tstat{Tag: 2, Fid: 0}, &rstat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Name != "/" {
+		t.Errorf("got '%s', want '%s'", rstat.Stat.Name, "/")
+	}
+	if rstat.Stat.Qid != rootQid {
+		t.Errorf("got %+v, want %+v", rstat.Stat.Qid, rootQid)
+	}
+
+	var rwalk Rwalk
+	err = c.rpc(&Twalk{Tag: 3, Fid: 0, Newfid: 1, Nwname: []string{"..", "file"}}, &rwalk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rwalk.Nwqid) != 2 || rwalk.Nwqid[0] != rootQid {
+		t.Errorf("got %+v, want '..' to stay at the attach root %+v", rwalk.Nwqid, rootQid)
+	}
+	err = c.rpc(&Tstat{Tag: 4, Fid: 1}, &rstat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Name != "file" {
+		t.Errorf("got '%s', want '%s'", rstat.Stat.Name, "file")
+	}
+}
+
+func TestVersionMsizeFloor(t *testing.T) {
+	c := newTestClient(t, NewMemFilesystem())
+	var rversion Rversion
+	err := c.rpc(&Tversion{Tag: 0xFFFF, Msize: 8, Version: ProtocolVersion}, &rversion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rversion.Msize != MinimumMsgSize {
+		t.Errorf("got msize %d, want %d", rversion.Msize, MinimumMsgSize)
+	}
+	c = newTestClient(t, NewMemFilesystem())
+	err = c.rpc(&Tversion{Tag: 0xFFFF, Msize: 1 << 20, Version: "9P1999"}, &rversion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rversion.Msize != MaximumMsgSize || rversion.Version != "unknown" {
+		t.Errorf("got %+v, want msize %d and version unknown", rversion, MaximumMsgSize)
+	}
+}
+
+func TestFidValidation(t *testing.T) {
+	for _, validate := range []bool{false, true} {
+		fs := NewMemFilesystem()
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		var opts []ServerOption
+		if validate {
+			opts = append(opts, WithFidValidation())
+		}
+		c := newTestClient(t, fs, opts...)
+		c.attach(0)
+		err := c.rpc(&Twalk{Tag: 2, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.rpc(&Tstat{Tag: 3, Fid: 1}, &Rstat{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fs.Remove("/file"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		err = c.rpc(&Tstat{Tag: 4, Fid: 1}, &Rstat{})
+		if validate && err != rerror(EStaleFidStr) {
+			t.Errorf("got %v, want %v", err, EStaleFidStr)
+		}
+		if !validate && err != nil {
+			t.Errorf("got %v without validation, want no error", err)
+		}
+		err = c.rpc(&Tstat{Tag: 5, Fid: 0}, &Rstat{})
+		if err != nil {
+			t.Errorf("got %v for the root fid, want no error", err)
+		}
+	}
+}
+
+func parseStats(t *testing.T, data []byte) []Stat {
+	var stats []Stat
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		if _, err := readUint[uint16](r); err != nil {
+			t.Fatal(err)
+		}
+		var stat Stat
+		if err := deserializeMessage3(r, reflect.ValueOf(&stat).Elem()); err != nil {
+			t.Fatal(err)
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func (c *testClient) readDir(fid uint32, path ...string) []Stat {
+	err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: fid, Nwname: path}, &Rwalk{})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	err = c.rpc(&Topen{Tag: 1, Fid: fid, Mode: OREAD}, &Ropen{})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var data []byte
+	for {
+		var rread Rread
+		err = c.rpc(&Tread{Tag: 1, Fid: fid, Offset: uint64(len(data)), Count: 4096}, &rread)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if len(rread.Data) == 0 {
+			break
+		}
+		data = append(data, rread.Data...)
+	}
+	return parseStats(c.t, data)
+}
+
+func TestReadDirCountTooSmall(t *testing.T) {
+	fs := NewMemFilesystem()
+	name := strings.Repeat("long", 50)
+	if err := fs.CreateFile("/"+name, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Topen{Tag: 1, Fid: 0, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	var rread Rread
+	if err := c.rpc(&Tread{Tag: 1, Fid: 0, Offset: 0, Count: 128}, &rread); err != nil {
+		t.Fatal(err)
+	}
+	// "." and ".." fit, the next entry does not.
+	offset := uint64(len(rread.Data))
+	err := c.rpc(&Tread{Tag: 1, Fid: 0, Offset: offset, Count: 128}, &Rread{})
+	if err != rerror(ECountTooSmallStr) {
+		t.Errorf("got %v, want %v", err, ECountTooSmallStr)
+	}
+	if err := c.rpc(&Tread{Tag: 1, Fid: 0, Offset: offset, Count: 1024}, &rread); err != nil {
+		t.Fatal(err)
+	}
+	if len(rread.Data) == 0 {
+		t.Error("got an empty read, want the long entry")
+	}
+}
+
+func TestReadDirDotEntries(t *testing.T) {
+	fs := NewMemFilesystem()
+	for _, dir := range []string{"/a", "/a/b"} {
+		if err := fs.CreateDir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qids := make(map[string]Qid)
+	for _, path := range []string{"/", "/a", "/a/b"} {
+		stat, err := fs.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qids[path] = stat.Qid
+	}
+	c := newTestClient(t, fs)
+	c.attach(0)
+
+	for i, test := range []struct {
+		walk   []string
+		dot    string
+		dotDot string
+	}{
+		{[]string{}, "/", "/"},
+		{[]string{"a"}, "/a", "/"},
+		{[]string{"a", "b"}, "/a/b", "/a"},
+	} {
+		stats := c.readDir(uint32(i+1), test.walk...)
+		if len(stats) < 2 || stats[0].Name != "." || stats[1].Name != ".." {
+			t.Fatalf("got %+v, want '.' and '..' first", stats)
+		}
+		if stats[0].Qid != qids[test.dot] {
+			t.Errorf("got '.' qid %+v in %s, want %+v", stats[0].Qid, test.dot, qids[test.dot])
+		}
+		if stats[1].Qid != qids[test.dotDot] {
+			t.Errorf("got '..' qid %+v in %s, want %+v", stats[1].Qid, test.dot, qids[test.dotDot])
+		}
+	}
+}
+
+func TestClunkReleasesDirectories(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	c := newTestClient(t, fs)
+	c.attach(0)
+	const dirs = 100
+	for i := uint32(1); i <= dirs; i++ {
+		name := fmt.Sprintf("dir%d", i)
+		if err := fs.CreateDir("/"+name, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: i, Nwname: []string{name}}, &Rwalk{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.rpc(&Topen{Tag: 1, Fid: i, Mode: OREAD}, &Ropen{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&fs.(*localFilesystem).openFiles); n != dirs {
+		t.Fatalf("got %d open files, want %d", n, dirs)
+	}
+	for i := uint32(1); i <= dirs; i++ {
+		err := c.rpc(&Tclunk{Tag: 1, Fid: i}, &Rclunk{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&fs.(*localFilesystem).openFiles); n != 0 {
+		t.Errorf("got %d open files after clunking, want 0", n)
+	}
+}
+
+func TestReadOffsetOverflow(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := newTestClient(t, fs)
+		c.attach(0)
+		for fid, path := range map[uint32][]string{1: {}, 2: {"file"}} {
+			err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: fid, Nwname: path}, &Rwalk{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.rpc(&Topen{Tag: 1, Fid: fid, Mode: OREAD}, &Ropen{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, offset := range []uint64{math.MaxUint64, math.MaxUint64 - 10, math.MaxInt64 + 1} {
+				var rread Rread
+				err = c.rpc(&Tread{Tag: 1, Fid: fid, Offset: offset, Count: 4096}, &rread)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if len(rread.Data) != 0 {
+					t.Errorf("%s: got %d bytes at offset %d, want none", name, len(rread.Data), offset)
+				}
+			}
+		}
+	}
+}
+
+func TestEmptyNames(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateFile("/a", 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, fs)
+	c.attach(0)
+	err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"", "a"}}, &Rwalk{})
+	if err != rerror(EEmptyNameStr) {
+		t.Errorf("got %v, want %v", err, EEmptyNameStr)
+	}
+	err = c.rpc(&Tclunk{Tag: 1, Fid: 1}, &Rclunk{})
+	if err != rerror(EBadMessageStr) {
+		t.Errorf("got %v, want the rejected walk not to create fid 1", err)
+	}
+	err = c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1}, &Rwalk{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.rpc(&Tcreate{Tag: 1, Fid: 1, Name: "", Perm: 0644, Mode: ORDWR}, &Rcreate{})
+	if err != rerror(EEmptyNameStr) {
+		t.Errorf("got %v, want %v", err, EEmptyNameStr)
+	}
+}
+
+func TestBadNames(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateDir("/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("/b", 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, fs)
+	c.attach(0)
+	for _, names := range [][]string{{"a", "../b"}, {"a/b"}, {"b\x00"}} {
+		err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: names}, &Rwalk{})
+		if err != rerror(EBadNameStr) {
+			t.Errorf("walk %q: got %v, want %v", names, err, EBadNameStr)
+		}
+	}
+	err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"a"}}, &Rwalk{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../c", "c/d", "c\x00", ".."} {
+		err = c.rpc(&Tcreate{Tag: 1, Fid: 1, Name: name, Perm: 0644, Mode: ORDWR}, &Rcreate{})
+		if err != rerror(EBadNameStr) {
+			t.Errorf("create %q: got %v, want %v", name, err, EBadNameStr)
+		}
+	}
+	if _, err := fs.Stat("/c"); err != ErrDoesNotExist {
+		t.Errorf("got %v, want %v", err, ErrDoesNotExist)
+	}
+}
+
+func TestNofidAsNewFid(t *testing.T) {
+	c := newTestClient(t, NewMemFilesystem())
+	c.version()
+	err := c.rpc(&Tattach{Tag: 1, Fid: NOFID, Afid: NOFID, Uname: "user"}, &Rattach{})
+	if err != rerror(EBadMessageStr) {
+		t.Errorf("attach: got %v, want %v", err, EBadMessageStr)
+	}
+	const maxFid = NOFID - 1
+	if err := c.rpc(&Tattach{Tag: 1, Fid: maxFid, Afid: NOFID, Uname: "user"}, &Rattach{}); err != nil {
+		t.Fatal(err)
+	}
+	err = c.rpc(&Twalk{Tag: 1, Fid: maxFid, Newfid: NOFID, Nwname: []string{}}, &Rwalk{})
+	if err != rerror(EBadMessageStr) {
+		t.Errorf("walk: got %v, want %v", err, EBadMessageStr)
+	}
+	if err := c.rpc(&Twalk{Tag: 1, Fid: maxFid, Newfid: 0, Nwname: []string{}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNameNormalization(t *testing.T) {
+	const nfd = "cafe\u0301"
+	const nfc = "caf\u00e9"
+	fs := NewMemFilesystem()
+	c := newTestClient(t, fs, WithNameNormalization(norm.NFC))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tcreate{Tag: 1, Fid: 1, Name: nfd, Perm: 0644, Mode: ORDWR}, &Rcreate{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/" + nfc); err != nil {
+		t.Errorf("got %v, want the file created with its NFC name", err)
+	}
+	for i, name := range []string{nfc, nfd} {
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: uint32(2 + i), Nwname: []string{name}}, &Rwalk{}); err != nil {
+			t.Errorf("walk to %q: %v", name, err)
+		}
+	}
+}
+
+func TestCreateExisting(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		if err := fs.CreateDir("/dir", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile("/dir/child", 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fs.Open("/file", OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Write(0, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		c := newTestClient(t, fs)
+		c.attach(0)
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, existing := range []string{"file", "dir"} {
+			for _, perm := range []uint32{0644, DMDIR | 0755} {
+				err := c.rpc(&Tcreate{Tag: 1, Fid: 1, Name: existing, Perm: perm, Mode: OREAD}, &Rcreate{})
+				if err != rerror(EAlreadyExistsStr) {
+					t.Errorf("%s: creating %s with perm %#o: got %v, want %v", name, existing, perm, err, EAlreadyExistsStr)
+				}
+			}
+		}
+		stat, err := fs.Stat("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Qid.Ftype&QTDIR != 0 || stat.Length != 5 {
+			t.Errorf("%s: got the file changed to %+v", name, stat)
+		}
+		if entries, err := fs.ReadDir("/dir"); err != nil || len(entries) != 1 {
+			t.Errorf("%s: got entries %v and error %v, want the directory untouched", name, entries, err)
+		}
+		// The fid is still the unopened directory it was.
+		if err := c.rpc(&Tcreate{Tag: 1, Fid: 1, Name: "new", Perm: 0644, Mode: OREAD}, &Rcreate{}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestWstatDontTouch(t *testing.T) {
+	dontTouch := Stat{
+		Stype:  ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{^uint8(0), ^uint32(0), ^uint64(0)},
+		Mode:   ^uint32(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+	for name, fs := range testFilesystems(t) {
+		if err := fs.CreateFile("/file", 0640); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fs.Open("/file", OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Write(0, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		before, err := fs.Stat("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := newTestClient(t, fs)
+		c.attach(0)
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Twstat{Tag: 1, Fid: 1, Stat: dontTouch}, &Rwstat{}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		after, err := fs.Stat("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Name != before.Name || after.Mode != before.Mode || after.Length != before.Length || after.Mtime != before.Mtime {
+			t.Errorf("%s: got %+v, want %+v", name, after, before)
+		}
+	}
+}
+
+func TestWstatRename(t *testing.T) {
+	rename := func(name string) Stat {
+		stat := Stat{Stype: ^uint16(0), Dev: ^uint32(0), Qid: Qid{^uint8(0), ^uint32(0), ^uint64(0)}, Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)}
+		stat.Name = name
+		return stat
+	}
+	for name, fs := range testFilesystems(t) {
+		if err := fs.CreateDir("/dir", 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeMemFile(t, fs, "/dir/file", "hello")
+		writeMemFile(t, fs, "/dir/other", "x")
+
+		c := newTestClient(t, fs)
+		c.attach(0)
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"dir", "file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 2, Nwname: []string{"dir"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		var before Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &before); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Twstat{Tag: 1, Fid: 1, Stat: rename("renamed")}, &Rwstat{}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := fs.Stat("/dir/file"); err != ErrDoesNotExist {
+			t.Errorf("%s: got %v, want %v", name, err, ErrDoesNotExist)
+		}
+		if got := readMemFile(t, fs, "/dir/renamed"); got != "hello" {
+			t.Errorf("%s: got '%s', want '%s'", name, got, "hello")
+		}
+
+		for _, tc := range []struct {
+			fid     uint32
+			newName string
+			want    string
+		}{
+			{1, "other", EAlreadyExistsStr},
+			{1, "a/b", EBadNameStr},
+			{1, "..", EBadNameStr},
+			{0, "root", EPermissionDeniedStr},
+		} {
+			if err := c.rpc(&Twstat{Tag: 1, Fid: tc.fid, Stat: rename(tc.newName)}, &Rwstat{}); err != rerror(tc.want) {
+				t.Errorf("%s: %s: got %v, want %v", name, tc.newName, err, rerror(tc.want))
+			}
+		}
+
+		// The fids of the renamed file and of the files below a renamed
+		// directory follow them.
+		if err := c.rpc(&Twstat{Tag: 1, Fid: 2, Stat: rename("moved")}, &Rwstat{}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var after Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &after); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if after.Stat.Name != "renamed" {
+			t.Errorf("%s: got name %s, want %s", name, after.Stat.Name, "renamed")
+		}
+		if after.Stat.Qid.Path != before.Stat.Qid.Path {
+			t.Errorf("%s: got qid path %d, want %d", name, after.Stat.Qid.Path, before.Stat.Qid.Path)
+		}
+		if got := readMemFile(t, fs, "/moved/renamed"); got != "hello" {
+			t.Errorf("%s: got '%s', want '%s'", name, got, "hello")
+		}
+	}
+}
+
+func TestWstatMalformedStat(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, stat := range map[string][]byte{
+		// The sizes agree, but only the type of the stat follows them.
+		"short":        {4, 0, 2, 0, 0xff, 0xff},
+		"inconsistent": {6, 0, 2, 0, 0xff, 0xff, 0xff, 0xff},
+		"overlong":     {60, 0, 58, 0, 0xff, 0xff},
+	} {
+		body := []byte{TwstatType, 7, 0, 1, 0, 0, 0}
+		body = append(body, stat...)
+		frame := binary.LittleEndian.AppendUint32(nil, uint32(len(body)+4))
+		if _, err := c.conn.Write(append(frame, body...)); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := DeserializeMessage(c.conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rerr, ok := msg.(*Rerror); !ok || rerr.Tag != 7 || rerr.Ename != EBadMessageStr {
+			t.Errorf("%s: got %+v, want Rerror '%s' with tag 7", name, msg, EBadMessageStr)
+		}
+	}
+	var rstat Rstat
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Length != 5 || rstat.Stat.Mode != 0644 {
+		t.Errorf("got length %d and mode %#o, want the file unchanged", rstat.Stat.Length, rstat.Stat.Mode)
+	}
+}
+
+// blockingOpenFilesystem is a Filesystem whose opens signal opening and then
+// wait for release.
+type blockingOpenFilesystem struct {
+	Filesystem
+	opening chan struct{}
+	release chan struct{}
+}
+
+func (f blockingOpenFilesystem) Open(path string, mode uint8) (File, error) {
+	f.opening <- struct{}{}
+	<-f.release
+	return f.Filesystem.Open(path, mode)
+}
+
+func TestClunkDuringOpen(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	writeMemFile(t, fs, "/file", "hello")
+	blocking := blockingOpenFilesystem{fs, make(chan struct{}), make(chan struct{})}
+	c := newTestClient(t, blocking)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SerializeMessage(c.conn, &Topen{Tag: 1, Fid: 1, Mode: OREAD}); err != nil {
+		t.Fatal(err)
+	}
+	<-blocking.opening
+	if err := c.rpc(&Tclunk{Tag: 2, Fid: 1}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	close(blocking.release)
+	msg, err := DeserializeMessage(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rerr, ok := msg.(*Rerror); !ok || rerr.Ename != EBadMessageStr {
+		t.Errorf("got %+v, want Rerror '%s'", msg, EBadMessageStr)
+	}
+	// The clunk is not undone, and the file opened meanwhile is closed.
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &Rstat{}); err != rerror(EBadMessageStr) {
+		t.Errorf("got %v, want %v", err, rerror(EBadMessageStr))
+	}
+	if n := atomic.LoadInt64(&fs.(*localFilesystem).openFiles); n != 0 {
+		t.Errorf("got %d files left open, want 0", n)
+	}
+}
+
+func TestReopenOpenFid(t *testing.T) {
+	fs := NewLocalFilesystem(t.TempDir())
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != rerror(EFidAlreadyOpenStr) {
+			t.Errorf("got %v, want %v", err, rerror(EFidAlreadyOpenStr))
+		}
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 1}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&fs.(*localFilesystem).openFiles); n != 0 {
+		t.Errorf("got %d files left open, want 0", n)
+	}
+}
+
+func TestFidErrors(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, fs)
+	c.attach(0)
+	walk := func(newfid uint32) {
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: newfid, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk(1)
+	walk(2)
+	if err := c.rpc(&Topen{Tag: 1, Fid: 2, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	walk(3)
+	if err := c.rpc(&Topen{Tag: 1, Fid: 3, Mode: OWRITE}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		tmsg any
+		rmsg any
+		want string
+	}{
+		{"bad fid", &Tstat{Tag: 1, Fid: 9}, &Rstat{}, EBadMessageStr},
+		{"fid in use", &Twalk{Tag: 1, Fid: 0, Newfid: 1}, &Rwalk{}, EFidInUseStr},
+		{"read of unopened fid", &Tread{Tag: 1, Fid: 1, Count: 5}, &Rread{}, EFidNotOpenStr},
+		{"write to unopened fid", &Twrite{Tag: 1, Fid: 1, Data: []byte("x")}, &Rwrite{}, EFidNotOpenStr},
+		{"write to fid open for reading", &Twrite{Tag: 1, Fid: 2, Data: []byte("x")}, &Rwrite{}, EWrongModeStr},
+		{"read of fid open for writing", &Tread{Tag: 1, Fid: 3, Count: 5}, &Rread{}, EWrongModeStr},
+		{"open of open fid", &Topen{Tag: 1, Fid: 2, Mode: OREAD}, &Ropen{}, EFidAlreadyOpenStr},
+		{"create from open fid", &Tcreate{Tag: 1, Fid: 2, Name: "new", Perm: 0644, Mode: ORDWR}, &Rcreate{}, EFidAlreadyOpenStr},
+	} {
+		if err := c.rpc(tc.tmsg, tc.rmsg); err != rerror(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	// The errnos are what clients of dialects carrying them get.
+	for err, errno := range map[error]syscall.Errno{
+		ErrInvalidFid: errnoEBADF,
+		ErrFidInUse:   errnoEBADF,
+		ErrFidNotOpen: errnoEBADF,
+		ErrWrongMode:  errnoEBADF,
+	} {
+		if got := toNineError(err); got.Errno != errno {
+			t.Errorf("%v: got %+v, want errno %v", err, got, errno)
+		}
+	}
+}
+
+func TestOpenTruncate(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fs.Open("/file", OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Write(0, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		c := newTestClient(t, fs)
+		c.attach(0)
+		var rwalk Rwalk
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &rwalk); err != nil {
+			t.Fatal(err)
+		}
+		var ropen Ropen
+		if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OWRITE | OTRUNC}, &ropen); err != nil {
+			t.Fatal(err)
+		}
+		// Truncating right after the write, within the same second, still
+		// changes the version.
+		if ropen.Qid.Version == rwalk.Nwqid[0].Version {
+			t.Errorf("%s: got version %d after truncating, want it changed", name, ropen.Qid.Version)
+		}
+		var rstat Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+			t.Fatal(err)
+		}
+		if rstat.Stat.Length != 0 || rstat.Stat.Qid.Version != ropen.Qid.Version {
+			t.Errorf("%s: got length %d and version %d, want 0 and %d", name, rstat.Stat.Length, rstat.Stat.Qid.Version, ropen.Qid.Version)
+		}
+	}
+}
+
+func TestCreateTag(t *testing.T) {
+	c := newTestClient(t, NewMemFilesystem())
+	c.attach(0)
+	var rcreate Rcreate
+	if err := c.rpc(&Tcreate{Tag: 42, Fid: 0, Name: "file", Perm: 0644, Mode: ORDWR}, &rcreate); err != nil {
+		t.Fatal(err)
+	}
+	if rcreate.Tag != 42 {
+		t.Errorf("got tag %d, want %d", rcreate.Tag, 42)
+	}
+}
+
+func TestCreateDirOpensForReading(t *testing.T) {
+	fs := NewMemFilesystem()
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	var rcreate Rcreate
+	if err := c.rpc(&Tcreate{Tag: 1, Fid: 1, Name: "dir", Perm: DMDIR | 0755, Mode: OREAD}, &rcreate); err != nil {
+		t.Fatal(err)
+	}
+	if rcreate.Qid.Ftype&QTDIR == 0 {
+		t.Fatalf("got qid type %#x, want a directory", rcreate.Qid.Ftype)
+	}
+	err := c.rpc(&Twrite{Tag: 1, Fid: 1, Offset: 0, Data: []byte("data")}, &Rwrite{})
+	if err != rerror(EWrongModeStr) {
+		t.Errorf("got %v, want %v", err, EWrongModeStr)
+	}
+	var rread Rread
+	if err := c.rpc(&Tread{Tag: 1, Fid: 1, Offset: 0, Count: 1024}, &rread); err != nil {
+		t.Fatal(err)
+	}
+	if len(rread.Data) == 0 {
+		t.Error("got an empty read, want the entries . and ..")
+	}
+}
+
+func TestCreateOpensWithMode(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		c := newTestClient(t, fs)
+		c.attach(0)
+		create := func(fid uint32, name string, perm uint32, mode uint8) error {
+			if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: fid, Nwname: []string{}}, &Rwalk{}); err != nil {
+				t.Fatal(err)
+			}
+			return c.rpc(&Tcreate{Tag: 1, Fid: fid, Name: name, Perm: perm, Mode: mode}, &Rcreate{})
+		}
+		// A file nobody may write can be created for reading.
+		if err := create(1, "readonly", 0444, OREAD); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := c.rpc(&Twrite{Tag: 1, Fid: 1, Data: []byte("data")}, &Rwrite{}); err != rerror(EWrongModeStr) {
+			t.Errorf("%s: got %v, want %v", name, err, rerror(EWrongModeStr))
+		}
+		if err := create(2, "writeonly", 0644, OWRITE); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := c.rpc(&Tread{Tag: 1, Fid: 2, Count: 5}, &Rread{}); err != rerror(EWrongModeStr) {
+			t.Errorf("%s: got %v, want %v", name, err, rerror(EWrongModeStr))
+		}
+	}
+}
+
+func TestCreateUnsupportedType(t *testing.T) {
+	fs := NewMemFilesystem()
+	c := newTestClient(t, fs)
+	c.attach(0)
+	err := c.rpc(&Tcreate{Tag: 1, Fid: 0, Name: "link", Perm: DMSYMLINK | 0777, Mode: OREAD}, &Rcreate{})
+	if err != rerror(ENotSupportedStr) {
+		t.Errorf("got %v, want %v", err, ENotSupportedStr)
+	}
+	if _, err := fs.Stat("/link"); err != ErrDoesNotExist {
+		t.Errorf("got %v, want %v", err, ErrDoesNotExist)
+	}
+}
+
+func TestIndependentAttaches(t *testing.T) {
+	fs := NewMemFilesystem()
+	for _, dir := range []string{"/a", "/b"} {
+		if err := fs.CreateDir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile(dir+"/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestClient(t, fs)
+	c.attachTree(0, "a")
+	var rattach Rattach
+	err := c.rpc(&Tattach{Tag: 1, Fid: 1, Afid: NOFID, Uname: "user", Aname: "b"}, &rattach)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user", Aname: "b"}, &rattach)
+	if err != rerror(EFidInUseStr) {
+		t.Errorf("got %v, want %v", err, EFidInUseStr)
+	}
+
+	var rwalkA, rwalkB Rwalk
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 2, Nwname: []string{"..", "file"}}, &rwalkA); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 1, Newfid: 3, Nwname: []string{"..", "file"}}, &rwalkB); err != nil {
+		t.Fatal(err)
+	}
+	if rwalkA.Nwqid[1] == rwalkB.Nwqid[1] {
+		t.Errorf("got the same qid %v for both trees", rwalkA.Nwqid[1])
+	}
+	err = c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 3}, &Rwalk{})
+	if err != rerror(EFidInUseStr) {
+		t.Errorf("got %v, want %v", err, EFidInUseStr)
+	}
+
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 0}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, fid := range []uint32{1, 2, 3} {
+		var rstat Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: fid}, &rstat); err != nil {
+			t.Errorf("fid %d: got %v after clunking the other root", fid, err)
+		}
+	}
+	err = c.rpc(&Twalk{Tag: 1, Fid: 1, Newfid: 0, Nwname: []string{"file"}}, &Rwalk{})
+	if err != nil {
+		t.Errorf("got %v, want the clunked fid to be reusable", err)
+	}
+}
+
+// shortWriteFilesystem is a Filesystem whose files fail after writing half of
+// the data given to Write.
+type shortWriteFilesystem struct {
+	Filesystem
+}
+
+type shortWriteFile struct {
+	File
+}
+
+func (f shortWriteFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.Filesystem.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return shortWriteFile{file}, nil
+}
+
+func (f shortWriteFile) Write(offset uint64, data []byte) error {
+	n := len(data) / 2
+	if err := f.File.Write(offset, data[:n]); err != nil {
+		return err
+	}
+	return &PartialWriteError{n, ErrIOError}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 64*1024)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, NewLocalFilesystem(dir))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	const reads = 16
+	const count = 4096
+	// Send every Tread before reading any reply, so that they are all
+	// outstanding at once.
+	go func() {
+		for i := 0; i < reads; i++ {
+			frame := new(bytes.Buffer)
+			if err := SerializeMessage(frame, &Tread{Tag: uint16(i), Fid: 1, Offset: uint64(i * count), Count: count}); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := c.conn.Write(frame.Bytes()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	seen := make(map[uint16]bool)
+	for i := 0; i < reads; i++ {
+		msg, err := DeserializeMessage(c.conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rread, ok := msg.(*Rread)
+		if !ok {
+			t.Fatalf("got %T, want *Rread", msg)
+		}
+		if seen[rread.Tag] {
+			t.Fatalf("got tag %d twice", rread.Tag)
+		}
+		seen[rread.Tag] = true
+		offset := int(rread.Tag) * count
+		if !bytes.Equal(rread.Data, content[offset:offset+count]) {
+			t.Errorf("tag %d: got wrong data for offset %d", rread.Tag, offset)
+		}
+	}
+}
+
+func TestReadAfterTruncate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, NewLocalFilesystem(dir))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	stat := Stat{Stype: ^uint16(0), Dev: ^uint32(0), Qid: Qid{^uint8(0), ^uint32(0), ^uint64(0)}, Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: 5}
+	if err := c.rpc(&Twstat{Tag: 1, Fid: 1, Stat: stat}, &Rwstat{}); err != nil {
+		t.Fatal(err)
+	}
+	var rread Rread
+	if err := c.rpc(&Tread{Tag: 1, Fid: 1, Offset: 6, Count: 16}, &rread); err != nil {
+		t.Fatal(err)
+	}
+	if len(rread.Data) != 0 {
+		t.Errorf("got '%s', want an empty read", rread.Data)
+	}
+	var rstat Rstat
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Length != 5 {
+		t.Errorf("got length %d, want %d", rstat.Stat.Length, 5)
+	}
+}
+
+// slowReadFilesystem is a Filesystem whose files take delay to read.
+type slowReadFilesystem struct {
+	Filesystem
+	delay time.Duration
+}
+
+type slowReadFile struct {
+	File
+	delay time.Duration
+}
+
+func (f slowReadFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.Filesystem.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return slowReadFile{file, f.delay}, nil
+}
+
+func (f slowReadFile) Read(offset uint64, count uint32) ([]byte, error) {
+	time.Sleep(f.delay)
+	return f.File.Read(offset, count)
+}
+
+// fragmentedReadFilesystem serves files whose reads are put together from
+// reads of at most piece bytes of the underlying files.
+type fragmentedReadFilesystem struct {
+	Filesystem
+	piece uint32
+}
+
+type fragmentedReadFile struct {
+	File
+	piece uint32
+}
+
+func (f fragmentedReadFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.Filesystem.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return fragmentedReadFile{file, f.piece}, nil
+}
+
+func (f fragmentedReadFile) Read(offset uint64, count uint32) ([]byte, error) {
+	var data []byte
+	for uint32(len(data)) < count {
+		b, err := f.File.Read(offset+uint64(len(data)), min(f.piece, count-uint32(len(data))))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			break
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+func TestFragmentedRead(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", MaximumMsgSize/8)
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", content)
+	c := newTestClient(t, fragmentedReadFilesystem{fs, 4093})
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []uint64{0, 1, uint64(len(content)) - 10000} {
+		var rread Rread
+		if err := c.rpc(&Tread{Tag: 1, Fid: 1, Offset: offset, Count: ^uint32(0)}, &rread); err != nil {
+			t.Fatal(err)
+		}
+		want := content[offset:min(uint64(len(content)), offset+MaximumMsgSize-IOHDRSZ)]
+		if string(rread.Data) != want {
+			t.Errorf("offset %d: got %d bytes, want %d", offset, len(rread.Data), len(want))
+		}
+	}
+	// The frames were sized right if the stream is still in sync.
+	if err := c.rpc(&Tstat{Tag: 2, Fid: 1}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// overlongReadFilesystem serves files whose reads ignore the count and return
+// the rest of the file.
+type overlongReadFilesystem struct {
+	Filesystem
+}
+
+type overlongReadFile struct {
+	File
+}
+
+func (f overlongReadFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.Filesystem.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return overlongReadFile{file}, nil
+}
+
+func (f overlongReadFile) Read(offset uint64, count uint32) ([]byte, error) {
+	return f.File.Read(offset, math.MaxInt32)
+}
+
+func TestOverlongRead(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", strings.Repeat("x", 2*MaximumMsgSize))
+	c := newTestClient(t, overlongReadFilesystem{fs})
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, count := range []uint32{10, ^uint32(0)} {
+		err := c.rpc(&Tread{Tag: 1, Fid: 1, Offset: 0, Count: count}, &Rread{})
+		if err != rerror(EIOErrorStr) {
+			t.Errorf("count %d: got %v, want %v", count, err, rerror(EIOErrorStr))
+		}
+	}
+	if err := c.rpc(&Tstat{Tag: 2, Fid: 1}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, for capturing logs.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, slowReadFilesystem{fs, 50 * time.Millisecond}, WithSlowRequestLog(20*time.Millisecond))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tread{Tag: 1, Fid: 1, Count: 5}, &Rread{}); err != nil {
+		t.Fatal(err)
+	}
+	// The warning is logged after the reply is sent.
+	want := "warning: slow request: Tread fid 1 path /file took "
+	for i := 0; i < 500 && !strings.Contains(logs.String(), want); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("got logs:\n%s\nwant them to contain %q", logs, want)
+	}
+	if strings.Contains(logs.String(), "slow request: Topen") {
+		t.Errorf("got logs:\n%s\nwant only the read to be slow", logs)
+	}
+}
+
+func TestConcurrentClunkAndRead(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, slowReadFilesystem{NewLocalFilesystem(dir), 10 * time.Millisecond})
+	c.attach(0)
+	for i := 0; i < 10; i++ {
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+			t.Fatal(err)
+		}
+		msgs := []any{&Tread{Tag: 1, Fid: 1, Count: 5}, &Tclunk{Tag: 2, Fid: 1}}
+		if i%2 == 1 {
+			msgs[0], msgs[1] = msgs[1], msgs[0]
+		}
+		frame := new(bytes.Buffer)
+		for _, msg := range msgs {
+			if err := SerializeMessage(frame, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := c.conn.Write(frame.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		for range msgs {
+			msg, err := DeserializeMessage(c.conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The read either completes or finds the fid clunked.
+			switch msg := msg.(type) {
+			case *Rread:
+				if string(msg.Data) != "hello" {
+					t.Errorf("got '%s', want 'hello'", msg.Data)
+				}
+			case *Rerror:
+				if msg.Tag != 1 || msg.Ename != EBadMessageStr {
+					t.Errorf("got %+v, want a failed read of a clunked fid", msg)
+				}
+			case *Rclunk:
+			default:
+				t.Fatalf("got %T", msg)
+			}
+		}
+	}
+}
+
+// readerAtFilesystem serves files which can only be read with ReadAt.
+type readerAtFilesystem struct {
+	Filesystem
+}
+
+type readerAtFile struct {
+	File
+}
+
+func (f readerAtFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.Filesystem.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return readerAtFile{file}, nil
+}
+
+func (f readerAtFile) Read(offset uint64, count uint32) ([]byte, error) {
+	return nil, errors.New("read with Read")
+}
+
+func (f readerAtFile) ReadAt(p []byte, offset int64) (int, error) {
+	data, err := f.File.Read(uint64(offset), uint32(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestReadFromReaderAt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewLocalFilesystem(dir).Open("/file", OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if _, ok := file.(ReaderAtFile); !ok {
+		t.Errorf("got %T, want a ReaderAtFile", file)
+	}
+
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, readerAtFilesystem{fs})
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset uint64
+		count  uint32
+		want   string
+	}{
+		{0, 1024, "hello"},
+		{1, 3, "ell"},
+		{5, 1024, ""},
+	} {
+		var rread Rread
+		if err := c.rpc(&Tread{Tag: 1, Fid: 1, Offset: tc.offset, Count: tc.count}, &rread); err != nil {
+			t.Fatal(err)
+		}
+		if string(rread.Data) != tc.want {
+			t.Errorf("offset %d: got '%s', want '%s'", tc.offset, rread.Data, tc.want)
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(listener, NewMemFilesystem(), false, WithMaxSessions(1))
+	go func() {
+		_ = server.AcceptLoop()
+	}()
+	defer server.Shutdown(context.Background())
+	dial := func() *testClient {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return &testClient{t: t, conn: conn}
+	}
+	first := dial()
+	first.version()
+	second := dial()
+	defer second.conn.Close()
+	if _, err := second.conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want the second connection closed", err)
+	}
+	first.conn.Close()
+	// The slot is freed once the server noticed the first connection closed.
+	for i := 0; ; i++ {
+		third := dial()
+		defer third.conn.Close()
+		err := third.rpc(&Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: ProtocolVersion}, &Rversion{})
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingStatFilesystem fails every Stat with an error of no meaning to 9P.
+type failingStatFilesystem struct {
+	Filesystem
+}
+
+func (f failingStatFilesystem) Stat(path string) (Stat, error) {
+	return Stat{}, errors.New("backend failure")
+}
+
+// rootStatFilesystem fails to stat its root with err.
+type rootStatFilesystem struct {
+	Filesystem
+	err error
+}
+
+func (f rootStatFilesystem) Stat(path string) (Stat, error) {
+	if path == "/" {
+		return Stat{}, f.err
+	}
+	return f.Filesystem.Stat(path)
+}
+
+func TestAttachInaccessibleRoot(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateDir("/tree", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		err  error
+		want error
+	}{
+		{ErrPermissionDenied, rerror(EPermissionDeniedStr)},
+		{ErrDoesNotExist, rerror(ENoSuchFileOrDirectoryStr)},
+	} {
+		c := newTestClient(t, rootStatFilesystem{fs, test.err})
+		c.version()
+		err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user", Aname: ""}, &Rattach{})
+		if err != test.want {
+			t.Errorf("got %v, want %v", err, test.want)
+		}
+		// The fid was not kept, so it can be attached again.
+		if err := c.rpc(&Tstat{Tag: 1, Fid: 0}, &Rstat{}); err != rerror(EBadMessageStr) {
+			t.Errorf("got %v, want %v", err, rerror(EBadMessageStr))
+		}
+		if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user", Aname: "tree"}, &Rattach{}); err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+	}
+}
+
+func TestEndReason(t *testing.T) {
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	// Sessions of other tests may still be ending, so other reasons are
+	// ignored.
+	waitForClose := func(want string) {
+		t.Helper()
+		line := "connection closed: pipe reason=" + want + "\n"
+		for i := 0; i < 500 && !strings.Contains(logs.String(), line); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("got logs:\n%s\nwant reason=%s", logs, want)
+		}
+		logs.mutex.Lock()
+		logs.buffer.Reset()
+		logs.mutex.Unlock()
+	}
+
+	c := newTestClient(t, NewMemFilesystem())
+	c.attach(0)
+	c.conn.Close()
+	waitForClose("eof")
+
+	c = newTestClient(t, NewMemFilesystem())
+	if _, err := c.conn.Write([]byte{5, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	waitForClose("protocol_error")
+
+	clock := newFakeClock()
+	c = newTestClient(t, NewMemFilesystem(), WithClock(clock), WithIdleTimeout(time.Minute))
+	c.attach(0)
+	clock.advance(time.Minute)
+	waitForClose("timeout")
+
+	server := NewServer(nil, NewMemFilesystem(), false)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		_ = server.ServeConn(serverConn)
+	}()
+	c = &testClient{t, clientConn}
+	c.attach(0)
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitForClose("server_shutdown")
+
+	c = newTestClient(t, failingStatFilesystem{NewMemFilesystem()})
+	c.version()
+	if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user"}, &Rattach{}); err == nil {
+		t.Error("got the attach answered, want the session to end")
+	}
+	waitForClose("io_error")
+}
+
+func TestHalfClose(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = NewServer(nil, slowReadFilesystem{fs, 100 * time.Millisecond}, false).ServeConn(conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn}
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SerializeMessage(conn, &Tread{Tag: 2, Fid: 1, Offset: 0, Count: 16}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := DeserializeMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rread, ok := msg.(*Rread); !ok || string(rread.Data) != "hello" {
+		t.Errorf("got %+v, want an Rread of '%s'", msg, "hello")
+	}
+	if _, err := DeserializeMessage(conn); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+// blockingReadFilesystem is a Filesystem whose files block reads until release
+// is closed.
+type blockingReadFilesystem struct {
+	Filesystem
+	release chan struct{}
+}
+
+type blockingReadFile struct {
+	File
+	release chan struct{}
+}
+
+func (f blockingReadFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.Filesystem.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return blockingReadFile{file, f.release}, nil
+}
+
+func (f blockingReadFile) Read(offset uint64, count uint32) ([]byte, error) {
+	<-f.release
+	return f.File.Read(offset, count)
+}
+
+func TestOrderedReplies(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	for _, ordered := range []bool{false, true} {
+		release := make(chan struct{})
+		var opts []ServerOption
+		if ordered {
+			opts = append(opts, WithOrderedReplies())
+		}
+		c := newTestClient(t, blockingReadFilesystem{fs, release}, opts...)
+		c.attach(0)
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+			t.Fatal(err)
+		}
+		// The read blocks until the stat sent after it was handled.
+		frame := new(bytes.Buffer)
+		for _, msg := range []any{&Tread{Tag: 1, Fid: 1, Count: 5}, &Tstat{Tag: 2, Fid: 0}, &Tstat{Tag: 3, Fid: 1}} {
+			if err := SerializeMessage(frame, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := c.conn.Write(frame.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		var tags []uint16
+		if !ordered {
+			// A stat is answered while the read is still blocked.
+			msg, err := DeserializeMessage(c.conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tags = append(tags, msg.(message).tag())
+		}
+		// Give the stats time to be handled before releasing the read.
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		for len(tags) < 3 {
+			msg, err := DeserializeMessage(c.conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tags = append(tags, msg.(message).tag())
+		}
+		if ordered && !reflect.DeepEqual(tags, []uint16{1, 2, 3}) {
+			t.Errorf("got replies to tags %v, want them in request order", tags)
+		}
+	}
+
+	// Reusing the tag of a request not answered yet ends the session rather
+	// than taking the turn of that request.
+	release := make(chan struct{})
+	c := newTestClient(t, blockingReadFilesystem{fs, release}, WithOrderedReplies())
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	frame := new(bytes.Buffer)
+	for _, msg := range []any{&Tread{Tag: 5, Fid: 1, Count: 5}, &Tstat{Tag: 5, Fid: 0}, &Tstat{Tag: 6, Fid: 0}} {
+		if err := SerializeMessage(frame, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.conn.Write(frame.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	msg, err := DeserializeMessage(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*Rread); !ok || msg.(message).tag() != 5 {
+		t.Errorf("got %T with tag %d, want Rread with tag 5", msg, msg.(message).tag())
+	}
+	if _, err := DeserializeMessage(c.conn); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	release := make(chan struct{})
+	// Replies which are the last ones owed are written at once, whatever the
+	// delay.
+	c := newTestClient(t, blockingReadFilesystem{fs, release}, WithWriteBatching(time.Hour))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reply buffered while another request is being handled is written
+	// once the delay has passed.
+	c = newTestClient(t, blockingReadFilesystem{fs, release}, WithWriteBatching(10*time.Millisecond))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = SerializeMessage(c.conn, &Tread{Tag: 2, Fid: 1, Offset: 0, Count: 16})
+		_ = SerializeMessage(c.conn, &Tstat{Tag: 3, Fid: 1})
+	}()
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := DeserializeMessage(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*Rstat); !ok {
+		t.Fatalf("got %T, want *Rstat", msg)
+	}
+	close(release)
+	msg, err = DeserializeMessage(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rread, ok := msg.(*Rread); !ok || string(rread.Data) != "hello" {
+		t.Errorf("got %+v, want an Rread of '%s'", msg, "hello")
+	}
+}
+
+// writeCountingConn is a net.Conn counting the calls to Write.
+type writeCountingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c writeCountingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func BenchmarkPipelinedStats(b *testing.B) {
+	const stats = 64
+	for _, bench := range []struct {
+		name string
+		opts []ServerOption
+	}{
+		{"unbatched", nil},
+		{"batched", []ServerOption{WithWriteBatching(time.Millisecond)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var writes int64
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			server := NewServer(nil, NewMemFilesystem(), false, bench.opts...)
+			go newSession(server, writeCountingConn{serverConn, &writes}).loop()
+			if err := SerializeMessage(clientConn, &Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: ProtocolVersion}); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := DeserializeMessage(clientConn); err != nil {
+				b.Fatal(err)
+			}
+			if err := SerializeMessage(clientConn, &Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user"}); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := DeserializeMessage(clientConn); err != nil {
+				b.Fatal(err)
+			}
+			requests := new(bytes.Buffer)
+			for i := 0; i < stats; i++ {
+				if err := SerializeMessage(requests, &Tstat{Tag: uint16(i), Fid: 0}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			atomic.StoreInt64(&writes, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				go func() {
+					_, _ = clientConn.Write(requests.Bytes())
+				}()
+				for j := 0; j < stats; j++ {
+					if _, err := DeserializeMessage(clientConn); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&writes))/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateFile("/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, shortWriteFilesystem{fs})
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OWRITE}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	var rwrite Rwrite
+	if err := c.rpc(&Twrite{Tag: 1, Fid: 1, Offset: 0, Data: []byte("abcdef")}, &rwrite); err != nil {
+		t.Fatal(err)
+	}
+	if rwrite.Count != 3 {
+		t.Errorf("got count %d, want %d", rwrite.Count, 3)
+	}
+	var rstat Rstat
+	if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+		t.Fatal(err)
+	}
+	if rstat.Stat.Length != 3 {
+		t.Errorf("got length %d, want %d", rstat.Stat.Length, 3)
+	}
+}
+
+// syncCountingFilesystem is a Filesystem counting the calls to Sync of its
+// files.
+type syncCountingFilesystem struct {
+	Filesystem
+	syncs *int32
+}
+
+type syncCountingFile struct {
+	File
+	syncs *int32
+}
+
+func (f syncCountingFilesystem) Open(path string, mode uint8) (File, error) {
+	file, err := f.Filesystem.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	return syncCountingFile{file, f.syncs}, nil
+}
+
+func (f syncCountingFile) Sync() error {
+	atomic.AddInt32(f.syncs, 1)
+	return f.File.Sync()
+}
+
+func TestSyncPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     SyncPolicy
+		want       int32
+		wantSwrite int32
+	}{
+		{"always", SyncAlways, 2, 1},
+		{"on-clunk", SyncOnClunk, 1, 1},
+		{"never", SyncNever, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := NewMemFilesystem()
+			if err := fs.CreateFile("/file", 0644); err != nil {
+				t.Fatal(err)
+			}
+			var syncs int32
+			c := newTestClient(t, syncCountingFilesystem{fs, &syncs}, WithSyncPolicy(test.policy))
+			c.attach(0)
+			if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: ORDWR}, &Ropen{}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := c.rpc(&Twrite{Tag: 1, Fid: 1, Offset: uint64(i), Data: []byte("a")}, &Rwrite{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.rpc(&Tclunk{Tag: 1, Fid: 1}, &Rclunk{}); err != nil {
+				t.Fatal(err)
+			}
+			if got := atomic.LoadInt32(&syncs); got != test.want {
+				t.Errorf("got %d syncs, want %d", got, test.want)
+			}
+
+			atomic.StoreInt32(&syncs, 0)
+			c = newTestClient(t, syncCountingFilesystem{fs, &syncs}, WithSyncPolicy(test.policy))
+			if err := c.rpc(&Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: ProtocolVersionE}, &Rversion{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user"}, &Rattach{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.rpc(&Tswrite{Tag: 1, Fid: 0, Nwname: []string{"file"}, Data: []byte("b")}, &Rswrite{}); err != nil {
+				t.Fatal(err)
+			}
+			if got := atomic.LoadInt32(&syncs); got != test.wantSwrite {
+				t.Errorf("got %d syncs for Tswrite, want %d", got, test.wantSwrite)
+			}
+		})
+	}
+}
+
+func newDirSession(tb testing.TB, entries int) *session {
+	fs := NewMemFilesystem()
+	if err := fs.CreateDir("/dir", 0755); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < entries; i++ {
+		if err := fs.CreateFile(fmt.Sprintf("/dir/file%05d", i), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	s := newSession(NewServer(nil, fs, false), nil)
+	file, err := fs.Open("/dir", OREAD)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.replaceFid(0, fidEntry{}, fidEntry{root: "/", path: "/dir", file: file})
+	return s
+}
+
+// readDirRebuilding reads the directory of fid 0 in count byte chunks,
+// serializing the whole directory again for every chunk.
+func readDirRebuilding(tb testing.TB, s *session, count uint32) []byte {
+	var data []byte
+	for {
+		listing, err := s.dirListing(s.fids[0])
+		if err != nil {
+			tb.Fatal(err)
+		}
+		chunk := dirEntriesAt(listing, uint64(len(data)), count)
+		if len(chunk) == 0 {
+			return data
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// readDirSnapshot reads the directory of fid 0 from offset in count byte
+// chunks like a client sending Tread messages.
+func readDirSnapshot(tb testing.TB, s *session, offset uint64, count uint32) []byte {
+	var data []byte
+	for {
+		chunk, err := s.readDir(&Tread{Fid: 0, Offset: offset + uint64(len(data)), Count: count}, s.fids[0])
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if len(chunk) == 0 {
+			return data
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func TestReadDirSnapshotMatchesRebuild(t *testing.T) {
+	s := newDirSession(t, 1000)
+	count := uint32(MaximumMsgSize - IOHDRSZ)
+	rebuilt := readDirRebuilding(t, s, count)
+	snapshot := readDirSnapshot(t, s, 0, count)
+	if !bytes.Equal(rebuilt, snapshot) {
+		t.Errorf("got a %d byte listing, want the %d byte rebuilt listing", len(snapshot), len(rebuilt))
+	}
+	if stats := parseStats(t, snapshot); len(stats) != 1002 {
+		t.Errorf("got %d entries, want %d", len(stats), 1002)
+	}
+}
+
+func TestReadDirSnapshotIsConsistent(t *testing.T) {
+	s := newDirSession(t, 100)
+	first, err := s.readDir(&Tread{Fid: 0, Offset: 0, Count: 512}, s.fids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.filesystem.CreateFile("/dir/added", 0644); err != nil {
+		t.Fatal(err)
+	}
+	rest := readDirSnapshot(t, s, uint64(len(first)), 512)
+	if stats := parseStats(t, append(first, rest...)); len(stats) != 102 {
+		t.Errorf("got %d entries, want the %d entries present when reading started", len(stats), 102)
+	}
+}
+
+func BenchmarkReadDir(b *testing.B) {
+	count := uint32(MaximumMsgSize - IOHDRSZ)
+	b.Run("Rebuild", func(b *testing.B) {
+		s := newDirSession(b, 10000)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			readDirRebuilding(b, s, count)
+		}
+	})
+	b.Run("Snapshot", func(b *testing.B) {
+		s := newDirSession(b, 10000)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			readDirSnapshot(b, s, 0, count)
+		}
+	})
+}
+
+func TestReuseClunkedFid(t *testing.T) {
+	c := newTestClient(t, NewMemFilesystem())
+	c.attach(0)
+	for i := 0; i < 100; i++ {
+		if err := c.rpc(&Tclunk{Tag: 1, Fid: 0}, &Rclunk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Tattach{Tag: 2, Fid: 0, Afid: NOFID, Uname: "user"}, &Rattach{}); err != nil {
+			t.Fatalf("attach %d: %v", i, err)
+		}
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 0}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 0}, &Rclunk{}); err != rerror(EBadMessageStr) {
+		t.Errorf("got %v, want %v", err, EBadMessageStr)
+	}
+}
+
+func TestClunkAttachRoot(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 0}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 1, Newfid: 2}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 1}, &Rclunk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tread{Tag: 1, Fid: 2, Count: 5}, &Rread{}); err != rerror(EFidNotOpenStr) {
+		t.Errorf("got %v, want the clone not to be open", err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 2, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	var rread Rread
+	if err := c.rpc(&Tread{Tag: 1, Fid: 2, Count: 5}, &rread); err != nil {
+		t.Fatal(err)
+	}
+	if string(rread.Data) != "hello" {
+		t.Errorf("got '%s', want '%s'", rread.Data, "hello")
+	}
+}
+
+func TestWalkOpenFid(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateDir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, fs, "/dir/file", "hello")
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"dir"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][]string{{}, {"file"}} {
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 1, Newfid: 2, Nwname: names}, &Rwalk{}); err != rerror(EFidOpenStr) {
+			t.Errorf("walk to %v: got %v, want %v", names, err, EFidOpenStr)
+		}
+	}
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 1, Newfid: 1}, &Rwalk{}); err != rerror(EFidOpenStr) {
+		t.Errorf("got %v, want %v", err, EFidOpenStr)
+	}
+	// The open fid is left as it was.
+	if err := c.rpc(&Tread{Tag: 1, Fid: 1, Count: 1024}, &Rread{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxDirListingBytes(t *testing.T) {
+	fs := NewMemFilesystem()
+	const dirs = 4
+	for i := 0; i < dirs; i++ {
+		dir := fmt.Sprintf("/dir%d", i)
+		if err := fs.CreateDir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			if err := fs.CreateFile(fmt.Sprintf("%s/file%05d", dir, j), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	const limit = 20000
+	s := newSession(NewServer(nil, fs, false, WithMaxDirListingBytes(limit)), nil)
+	for i := 0; i < dirs; i++ {
+		path := fmt.Sprintf("/dir%d", i)
+		file, err := fs.Open(path, OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.replaceFid(uint32(i), fidEntry{}, fidEntry{root: "/", path: path, file: file})
+	}
+	var want []byte
+	for i := 0; i < dirs; i++ {
+		data, err := s.readDir(&Tread{Fid: uint32(i), Offset: 0, Count: 64}, s.fids[uint32(i)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			want = data
+		}
+		if got := s.dirListings.bytes(); got > limit {
+			t.Fatalf("got %d bytes of listings, want at most %d", got, limit)
+		}
+	}
+	if _, ok := s.dirListings.get(0); ok {
+		t.Fatal("listing of the least recently read directory was kept")
+	}
+	// An evicted listing is taken again when reading goes on.
+	rest := readDirSnapshot(t, s, uint64(len(want)), 64)
+	if full := readDirRebuilding(t, s, 64); !bytes.Equal(append(want, rest...), full) {
+		t.Errorf("got a different listing after eviction")
+	}
+}
+
+func TestReadDirAfterEvictionOfChangedDir(t *testing.T) {
+	fs := NewMemFilesystem()
+	for _, path := range []string{"/dir", "/other"} {
+		if err := fs.CreateDir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"/dir/b", "/dir/c"} {
+		if err := fs.CreateFile(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newSession(NewServer(nil, fs, false, WithMaxDirListingBytes(1)), nil)
+	for i, path := range []string{"/dir", "/other"} {
+		file, err := fs.Open(path, OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.replaceFid(uint32(i), fidEntry{}, fidEntry{root: "/", path: path, file: file})
+	}
+	listing, err := s.readDir(&Tread{Fid: 0, Offset: 0, Count: 1024}, s.fids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []uint64
+	for offset := uint64(0); offset < uint64(len(listing)); offset += 2 + uint64(binary.LittleEndian.Uint16(listing[offset:])) {
+		offsets = append(offsets, offset)
+	}
+	if len(offsets) != 4 {
+		t.Fatalf("got %d entries, want 4", len(offsets))
+	}
+	if err := fs.Remove("/dir/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("/dir/bbbbbbbb", 0644); err != nil {
+		t.Fatal(err)
+	}
+	evict := func() {
+		t.Helper()
+		if _, err := s.readDir(&Tread{Fid: 1, Offset: 0, Count: 1024}, s.fids[1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.dirListings.get(0); ok {
+			t.Fatal("listing was not evicted")
+		}
+	}
+	// The entries before "bbbbbbbb" did not move.
+	evict()
+	if _, err := s.readDir(&Tread{Fid: 0, Offset: offsets[2], Count: 1024}, s.fids[0]); err != nil {
+		t.Fatal(err)
+	}
+	// Where "c" was is now inside "bbbbbbbb".
+	evict()
+	_, err = s.readDir(&Tread{Fid: 0, Offset: offsets[3], Count: 1024}, s.fids[0])
+	if err != ErrDirChanged {
+		t.Errorf("got %v, want %v", err, ErrDirChanged)
+	}
+}
+
+func TestDisabledMessages(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, fs, WithDisabledMessages(TwriteType, TcreateType, TremoveType, TwstatType))
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: ORDWR}, &Ropen{}); err != nil {
+		t.Fatal(err)
+	}
+	err := c.rpc(&Twrite{Tag: 1, Fid: 1, Data: []byte("bye")}, &Rwrite{})
+	if err != rerror(ENotPermittedStr) {
+		t.Errorf("got %v, want %v", err, ENotPermittedStr)
+	}
+	var rread Rread
+	if err := c.rpc(&Tread{Tag: 1, Fid: 1, Count: 16}, &rread); err != nil {
+		t.Fatal(err)
+	}
+	if string(rread.Data) != "hello" {
+		t.Errorf("got '%s', want '%s'", rread.Data, "hello")
+	}
+}
+
+func TestReadCountAboveIounit(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", string(make([]byte, 2*MaximumMsgSize)))
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+		t.Fatal(err)
+	}
+	var ropen Ropen
+	if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OREAD}, &ropen); err != nil {
+		t.Fatal(err)
+	}
+	if ropen.Iouint != MaximumMsgSize-IOHDRSZ {
+		t.Errorf("got iounit %d, want %d", ropen.Iouint, MaximumMsgSize-IOHDRSZ)
+	}
+	var rread Rread
+	if err := c.rpc(&Tread{Tag: 1, Fid: 1, Count: 2 * MaximumMsgSize}, &rread); err != nil {
+		t.Fatal(err)
+	}
+	if uint32(len(rread.Data)) != ropen.Iouint {
+		t.Errorf("got %d bytes, want %d", len(rread.Data), ropen.Iouint)
+	}
+}
+
+func TestMuid(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		if err := fs.CreateFile("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := newTestClient(t, fs)
+		c.version()
+		if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "glenda", Aname: ""}, &Rattach{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OWRITE}, &Ropen{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Twrite{Tag: 1, Fid: 1, Data: []byte("hello")}, &Rwrite{}); err != nil {
+			t.Fatal(err)
+		}
+		var rstat Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: 1}, &rstat); err != nil {
+			t.Fatal(err)
+		}
+		if rstat.Stat.Muid != "glenda" {
+			t.Errorf("%s: got muid '%s', want '%s'", name, rstat.Stat.Muid, "glenda")
+		}
+	}
+}
+
+func TestMaxDirEntries(t *testing.T) {
+	fs := NewMemFilesystem()
+	for i := 0; i < 10; i++ {
+		if err := fs.CreateFile(fmt.Sprintf("/file%d", i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestClient(t, fs, WithMaxDirEntries(4))
+	c.attach(0)
+	stats := c.readDir(1)
+	if len(stats) != 6 || stats[5].Name != "file3" {
+		t.Errorf("got %d entries, want '.', '..' and the first 4 files", len(stats))
+	}
+
+	// A local filesystem only reads as many entries from the host.
+	local := NewLocalFilesystem(t.TempDir())
+	for i := 0; i < 10; i++ {
+		if err := local.CreateFile(fmt.Sprintf("/file%d", i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c = newTestClient(t, local, WithMaxDirEntries(4))
+	c.attach(0)
+	if stats := c.readDir(1); len(stats) != 6 {
+		t.Errorf("got %d entries, want '.', '..' and 4 files", len(stats))
+	}
+}
+
+func TestDialectE(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateDir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, fs, "/dir/file", "hello")
+	c := newTestClient(t, fs)
+	var rversion Rversion
+	if err := c.rpc(&Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: ProtocolVersionE}, &rversion); err != nil {
+		t.Fatal(err)
+	}
+	if rversion.Version != ProtocolVersionE {
+		t.Fatalf("got version %s, want %s", rversion.Version, ProtocolVersionE)
+	}
+	if err := c.rpc(&Tsession{Tag: 1, Key: 42}, &Rsession{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user"}, &Rattach{}); err != nil {
+		t.Fatal(err)
+	}
+	var rsread Rsread
+	if err := c.rpc(&Tsread{Tag: 1, Fid: 0, Nwname: []string{"dir", "file"}}, &rsread); err != nil {
+		t.Fatal(err)
+	}
+	if string(rsread.Data) != "hello" {
+		t.Errorf("got '%s', want '%s'", rsread.Data, "hello")
+	}
+	var rswrite Rswrite
+	if err := c.rpc(&Tswrite{Tag: 1, Fid: 0, Nwname: []string{"dir", "file"}, Data: []byte("bye")}, &rswrite); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, fs, "/dir/file"); rswrite.Count != 3 || got != "bye" {
+		t.Errorf("got count %d and content '%s', want %d and '%s'", rswrite.Count, got, 3, "bye")
+	}
+	if err := c.rpc(&Tclunk{Tag: 1, Fid: 1}, &Rclunk{}); err != rerror(EBadMessageStr) {
+		t.Errorf("got %v, want no fid left behind", err)
+	}
+}
+
+func TestDialectDirectoryOffsets(t *testing.T) {
+	// Opening the directory sets its atime, which must not differ between
+	// the listings.
+	fs := NewMemFilesystem(WithMemClock(newFakeClock()))
+	for _, name := range []string{"a", "b", "c"} {
+		writeMemFile(t, fs, "/"+name, name)
+	}
+	var listings [][]byte
+	for _, version := range []string{ProtocolVersion, ProtocolVersionE} {
+		c := newTestClient(t, fs)
+		var rversion Rversion
+		if err := c.rpc(&Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: version}, &rversion); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user"}, &Rattach{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Topen{Tag: 1, Fid: 0, Mode: OREAD}, &Ropen{}); err != nil {
+			t.Fatal(err)
+		}
+		var listing []byte
+		for {
+			var rread Rread
+			err := c.rpc(&Tread{Tag: 1, Fid: 0, Offset: uint64(len(listing)), Count: 100}, &rread)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rread.Data) == 0 {
+				break
+			}
+			listing = append(listing, rread.Data...)
+		}
+		listings = append(listings, listing)
+	}
+	if !bytes.Equal(listings[0], listings[1]) {
+		t.Errorf("got different listings for %s and %s", ProtocolVersion, ProtocolVersionE)
+	}
+	c := newTestClient(t, fs)
+	var rversion Rversion
+	if err := c.rpc(&Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: "9P2000.L"}, &rversion); err != nil {
+		t.Fatal(err)
+	}
+	if rversion.Version != "unknown" {
+		t.Errorf("got version %s, want %s", rversion.Version, "unknown")
+	}
+}
+
+func TestDialectEMessagesRejected(t *testing.T) {
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+	c := newTestClient(t, fs)
+	c.attach(0)
+	if err := c.rpc(&Tsread{Tag: 1, Fid: 0, Nwname: []string{"file"}}, &Rsread{}); err == nil {
+		t.Errorf("got a reply to Tsread in %s", ProtocolVersion)
+	}
+}
+
+// openDenyingAuthorizer lets nobody open files.
+type openDenyingAuthorizer struct{}
+
+func (openDenyingAuthorizer) Authorize(conn ConnInfo, uname string, aname string) error {
+	return nil
+}
+
+func (openDenyingAuthorizer) AuthorizeOperation(conn ConnInfo, uname string, mtype uint8, path string) error {
+	if mtype == TopenType {
+		return errors.New("no opening")
+	}
+	return nil
+}
+
+func TestDialectEGuards(t *testing.T) {
+	attachE := func(fs Filesystem, opts ...ServerOption) *testClient {
+		c := newTestClient(t, fs, opts...)
+		if err := c.rpc(&Tversion{Tag: 0xFFFF, Msize: MaximumMsgSize, Version: ProtocolVersionE}, &Rversion{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Tattach{Tag: 1, Fid: 0, Afid: NOFID, Uname: "user"}, &Rattach{}); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	fs := NewMemFilesystem()
+	writeMemFile(t, fs, "/file", "hello")
+
+	for _, test := range []struct {
+		name string
+		opts []ServerOption
+		want error
+	}{
+		{"open disabled", []ServerOption{WithDisabledMessages(TopenType)}, rerror(ENotPermittedStr)},
+		{"open denied", []ServerOption{WithAuthorizer(openDenyingAuthorizer{})}, rerror(EPermissionDeniedStr)},
+	} {
+		c := attachE(fs, test.opts...)
+		if err := c.rpc(&Tsread{Tag: 1, Fid: 0, Nwname: []string{"file"}}, &Rsread{}); err != test.want {
+			t.Errorf("%s: Tsread: got %v, want %v", test.name, err, test.want)
+		}
+		err := c.rpc(&Tswrite{Tag: 1, Fid: 0, Nwname: []string{"file"}, Data: []byte("pwned")}, &Rswrite{})
+		if err != test.want {
+			t.Errorf("%s: Tswrite: got %v, want %v", test.name, err, test.want)
+		}
+	}
+	c := attachE(fs, WithDisabledMessages(TreadType, TwriteType))
+	if err := c.rpc(&Tsread{Tag: 1, Fid: 0, Nwname: []string{"file"}}, &Rsread{}); err != rerror(ENotPermittedStr) {
+		t.Errorf("read disabled: got %v, want %v", err, rerror(ENotPermittedStr))
+	}
+	if err := c.rpc(&Tswrite{Tag: 1, Fid: 0, Nwname: []string{"file"}, Data: []byte("pwned")}, &Rswrite{}); err != rerror(ENotPermittedStr) {
+		t.Errorf("write disabled: got %v, want %v", err, rerror(ENotPermittedStr))
+	}
+	if got := readMemFile(t, fs, "/file"); got != "hello" {
+		t.Errorf("got '%s', want '%s'", got, "hello")
+	}
+
+	// The write is synced before Rswrite, as the clunk ending it would.
+	recording := NewRecordingFilesystem(fs)
+	c = attachE(recording)
+	if err := c.rpc(&Tswrite{Tag: 1, Fid: 0, Nwname: []string{"file"}, Data: []byte("bye")}, &Rswrite{}); err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, call := range recording.Calls() {
+		if strings.HasPrefix(call.Method, "File.") {
+			methods = append(methods, call.Method)
+		}
+	}
+	if got, want := strings.Join(methods, " "), "File.Write File.Sync File.Close"; got != want {
+		t.Errorf("got calls '%s', want '%s'", got, want)
+	}
+
+	c = attachE(overlongReadFilesystem{fs})
+	if err := c.rpc(&Tsread{Tag: 1, Fid: 0, Nwname: []string{"file"}}, &Rsread{}); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	writeMemFile(t, fs, "/big", strings.Repeat("x", 2*MaximumMsgSize))
+	if err := c.rpc(&Tsread{Tag: 1, Fid: 0, Nwname: []string{"big"}}, &Rsread{}); err != rerror(EIOErrorStr) {
+		t.Errorf("got %v, want %v", err, rerror(EIOErrorStr))
+	}
+}
+
+func TestStatAfterWritePastEnd(t *testing.T) {
+	for name, fs := range testFilesystems(t) {
+		writeMemFile(t, fs, "/file", "abc")
+		c := newTestClient(t, fs)
+		c.attach(0)
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.rpc(&Topen{Tag: 1, Fid: 1, Mode: OWRITE}, &Ropen{}); err != nil {
+			t.Fatal(err)
+		}
+		var rwrite Rwrite
+		if err := c.rpc(&Twrite{Tag: 1, Fid: 1, Offset: 100, Data: []byte("hello")}, &rwrite); err != nil {
+			t.Fatal(err)
+		}
+		if rwrite.Count != 5 {
+			t.Errorf("%s: got count %d, want 5", name, rwrite.Count)
+		}
+		// Both the fid which wrote and one walked afterwards see the new length.
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 2, Nwname: []string{"file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, fid := range []uint32{1, 2} {
+			var rstat Rstat
+			if err := c.rpc(&Tstat{Tag: 1, Fid: fid}, &rstat); err != nil {
+				t.Fatal(err)
+			}
+			if rstat.Stat.Length != 105 {
+				t.Errorf("%s: fid %d: got length %d, want 105", name, fid, rstat.Stat.Length)
+			}
+		}
+	}
+}
+
+func TestReplyMessageEndsSession(t *testing.T) {
+	for _, msg := range []any{&Rstat{Tag: 1}, &Rread{Tag: 1, Data: []byte("data")}, &Rversion{Tag: 0xFFFF, Version: ProtocolVersion}} {
+		c := newTestClient(t, NewMemFilesystem())
+		c.attach(0)
+		if err := SerializeMessage(c.conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		// The deadline fails once the server closed the connection.
+		_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := DeserializeMessage(c.conn); err != io.EOF {
+			t.Errorf("%T: got %v, want %v", msg, err, io.EOF)
+		}
+	}
+}
+
+func TestFlushFinishedRequest(t *testing.T) {
+	c := newTestClient(t, NewMemFilesystem())
+	c.attach(0)
+	// A tag which was never outstanding.
+	if err := c.rpc(&Tflush{Tag: 1, Oldtag: 42}, &Rflush{}); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	// A tag whose reply was already sent.
+	if err := c.rpc(&Tstat{Tag: 5, Fid: 0}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.rpc(&Tflush{Tag: 1, Oldtag: 5}, &Rflush{}); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	// The session goes on, with the flushed tag free to be used again.
+	if err := c.rpc(&Tstat{Tag: 5, Fid: 0}, &Rstat{}); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
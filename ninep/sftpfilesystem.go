@@ -0,0 +1,297 @@
+//go:build sftp
+
+package ninep
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	p "path"
+	"sort"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+type sftpFilesystem struct {
+	client   *sftp.Client
+	basePath string
+	dev      uint32
+
+	qidMutex   sync.Mutex
+	qidCounter uint64
+	qidCache   *qidCache
+}
+
+type sftpFile struct {
+	fs         *sftpFilesystem
+	path       string
+	sftpFile   *sftp.File
+	osFileInfo os.FileInfo
+	qidPath    uint64
+}
+
+// NewSftpFilesystem returns a filesystem serving the directory basePath of the
+// SFTP server client is connected to.
+func NewSftpFilesystem(client *sftp.Client, basePath string) Filesystem {
+	return &sftpFilesystem{
+		client:   client,
+		basePath: basePath,
+		dev:      newSyntheticDev(),
+		qidCache: newQidCache(DefaultQidCacheSize),
+	}
+}
+
+func (f *sftpFilesystem) Open(path string, mode uint8) (File, error) {
+	fullPath := f.normalizePath(path)
+	fileInfo, err := f.client.Stat(fullPath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	if fileInfo.IsDir() {
+		return f.newFile(path, nil, fileInfo), nil
+	}
+	modeToFlag := map[uint8]int{OREAD: os.O_RDONLY, OWRITE: os.O_WRONLY, ORDWR: os.O_RDWR, OEXEC: os.O_RDONLY}
+	flag := modeToFlag[mode&3]
+	if mode&OTRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	file, err := f.client.OpenFile(fullPath, flag)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return f.newFile(path, file, fileInfo), nil
+}
+
+func (f *sftpFilesystem) CreateDir(path string, perm uint32) error {
+	fullPath := f.normalizePath(path)
+	if _, err := f.client.Stat(fullPath); !errors.Is(err, os.ErrNotExist) {
+		return ErrAlreadyExists
+	}
+	err := f.client.Mkdir(fullPath)
+	if err != nil {
+		return sftpError(err)
+	}
+	return sftpError(f.client.Chmod(fullPath, os.FileMode(perm)&os.ModePerm))
+}
+
+func (f *sftpFilesystem) CreateFile(path string, perm uint32) error {
+	fullPath := f.normalizePath(path)
+	file, err := f.client.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		if _, statErr := f.client.Stat(fullPath); statErr == nil {
+			return ErrAlreadyExists
+		}
+		return sftpError(err)
+	}
+	_ = file.Close()
+	return sftpError(f.client.Chmod(fullPath, os.FileMode(perm)&os.ModePerm))
+}
+
+func (f *sftpFilesystem) ReadDir(path string) ([]Stat, error) {
+	fileInfos, err := f.client.ReadDir(f.normalizePath(path))
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name() < fileInfos[j].Name() })
+	stats := make([]Stat, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		entryPath := p.Join(path, fileInfo.Name())
+		stats[i] = f.makeStat(f.qidPath(entryPath), fileInfo)
+	}
+	return stats, nil
+}
+
+func (f *sftpFilesystem) Remove(path string) error {
+	fullPath := f.normalizePath(path)
+	fileInfo, err := f.client.Stat(fullPath)
+	if err != nil {
+		return sftpError(err)
+	}
+	if !fileInfo.IsDir() {
+		return sftpError(f.client.Remove(fullPath))
+	}
+	entries, err := f.client.ReadDir(fullPath)
+	if err != nil {
+		return sftpError(err)
+	}
+	if len(entries) != 0 {
+		return ErrDirectoryNotEmpty
+	}
+	return sftpError(f.client.RemoveDirectory(fullPath))
+}
+
+func (f *sftpFilesystem) Stat(path string) (Stat, error) {
+	fileInfo, err := f.client.Stat(f.normalizePath(path))
+	if err != nil {
+		return Stat{}, sftpError(err)
+	}
+	return f.makeStat(f.qidPath(path), fileInfo), nil
+}
+
+func (f *sftpFilesystem) Readlink(path string) (string, error) {
+	target, err := f.client.ReadLink(f.normalizePath(path))
+	if err != nil {
+		return "", sftpError(err)
+	}
+	return target, nil
+}
+
+func (f *sftpFilesystem) Wstat(path string, stat Stat) error {
+	if stat.Name != "" {
+		return ErrNotSupported
+	}
+	// SFTP only knows owners by number, the names of the users of the server
+	// cannot be looked up. "?" is what Stat reports, leaving them as they are.
+	if (stat.Uid != "" && stat.Uid != "?") || (stat.Gid != "" && stat.Gid != "?") {
+		return ErrNotSupported
+	}
+	fullPath := f.normalizePath(path)
+	if stat.Mode != ^uint32(0) {
+		err := f.client.Chmod(fullPath, os.FileMode(stat.Mode)&os.ModePerm)
+		if err != nil {
+			return sftpError(err)
+		}
+	}
+	if stat.Length != ^uint64(0) {
+		fileInfo, err := f.client.Stat(fullPath)
+		if err != nil {
+			return sftpError(err)
+		}
+		// The length of a directory is always zero and may only be set to zero.
+		if fileInfo.IsDir() {
+			if stat.Length != 0 {
+				return ErrIOError
+			}
+			return nil
+		}
+		if stat.Length > math.MaxInt64 {
+			return ErrIOError
+		}
+		err = f.client.Truncate(fullPath, int64(stat.Length))
+		if err != nil {
+			return sftpError(err)
+		}
+	}
+	return nil
+}
+
+func (f *sftpFilesystem) newFile(path string, file *sftp.File, fileInfo os.FileInfo) *sftpFile {
+	return &sftpFile{fs: f, path: path, sftpFile: file, osFileInfo: fileInfo, qidPath: f.qidPath(path)}
+}
+
+func (f *sftpFilesystem) normalizePath(path string) string {
+	return p.Join(f.basePath, p.Clean("/"+path))
+}
+
+func (f *sftpFilesystem) makeStat(qidPath uint64, fileInfo os.FileInfo) Stat {
+	mode := uint32(fileInfo.Mode().Perm())
+	var length uint64
+	if fileInfo.IsDir() {
+		mode |= DMDIR
+	} else {
+		length = uint64(fileInfo.Size())
+	}
+	return Stat{
+		Dev:    f.dev,
+		Qid:    Qid{qidType(mode), uint32(fileInfo.ModTime().Unix()), qidPath},
+		Mode:   mode,
+		Length: length,
+		Name:   fileInfo.Name(),
+		Uid:    "?",
+		Gid:    "?",
+		Muid:   "",
+		Atime:  uint32(fileInfo.ModTime().Unix()),
+		Mtime:  uint32(fileInfo.ModTime().Unix()),
+	}
+}
+
+func (f *sftpFilesystem) qidPath(path string) uint64 {
+	f.qidMutex.Lock()
+	defer f.qidMutex.Unlock()
+	qidPath, ok := f.qidCache.get(path)
+	if ok {
+		return qidPath
+	}
+	qidPath = f.qidCounter
+	f.qidCache.put(path, qidPath)
+	f.qidCounter += 1
+	return qidPath
+}
+
+// sftpError translates an error of the SFTP client to the errors of this
+// package.
+func sftpError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrDoesNotExist
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return ErrPermissionDenied
+	}
+	log.Println(err)
+	return ErrIOError
+}
+
+func (f *sftpFile) Qid() Qid {
+	return f.fs.makeStat(f.qidPath, f.osFileInfo).Qid
+}
+
+func (f *sftpFile) IsDir() bool {
+	return f.osFileInfo.IsDir()
+}
+
+func (f *sftpFile) Stat() (Stat, error) {
+	fileInfo := f.osFileInfo
+	if f.sftpFile != nil {
+		var err error
+		fileInfo, err = f.sftpFile.Stat()
+		if err != nil {
+			return Stat{}, sftpError(err)
+		}
+	}
+	stat := f.fs.makeStat(f.qidPath, fileInfo)
+	stat.Name = p.Base(p.Clean("/" + f.path))
+	return stat, nil
+}
+
+func (f *sftpFile) Read(offset uint64, count uint32) ([]byte, error) {
+	if offset > math.MaxInt64 {
+		return []byte{}, nil
+	}
+	buffer := make([]byte, count)
+	n, err := f.sftpFile.ReadAt(buffer, int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, sftpError(err)
+	}
+	return buffer[:n], nil
+}
+
+func (f *sftpFile) Write(offset uint64, data []byte) error {
+	n, err := f.sftpFile.WriteAt(data, int64(offset))
+	if err != nil {
+		err = sftpError(err)
+		if n > 0 {
+			return &PartialWriteError{n, err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *sftpFile) Sync() error {
+	if f.sftpFile == nil {
+		return nil
+	}
+	return sftpError(f.sftpFile.Sync())
+}
+
+func (f *sftpFile) Close() {
+	if f.sftpFile != nil {
+		_ = f.sftpFile.Close()
+	}
+}
@@ -0,0 +1,135 @@
+//go:build sftp
+
+package ninep
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func newTestSftpFilesystem(t *testing.T) (Filesystem, string) {
+	dir := t.TempDir()
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return NewSftpFilesystem(client, dir), dir
+}
+
+func TestSftpFilesystemReadWrite(t *testing.T) {
+	fs, dir := newTestSftpFilesystem(t)
+	if err := os.WriteFile(filepath.Join(dir, "remote"), []byte("remote content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Open("/remote", OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := file.Read(7, 100)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Errorf("got '%s', want '%s'", data, "content")
+	}
+
+	if err := fs.CreateDir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("/dir/file", 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("/dir/file", 0640); err != ErrAlreadyExists {
+		t.Errorf("got %v, want %v", err, ErrAlreadyExists)
+	}
+	file, err = fs.Open("/dir/file", OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Write(0, []byte("hello"))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "dir", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got '%s', want '%s'", data, "hello")
+	}
+
+	stats, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != "file" || stats[0].Length != 5 || stats[0].Mode != 0640 {
+		t.Errorf("got %+v, want a single 5 byte entry named 'file' with mode 0640", stats)
+	}
+	if err := fs.Remove("/dir"); err != ErrDirectoryNotEmpty {
+		t.Errorf("got %v, want %v", err, ErrDirectoryNotEmpty)
+	}
+	if err := fs.Remove("/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/dir/file"); err != ErrDoesNotExist {
+		t.Errorf("got %v, want %v", err, ErrDoesNotExist)
+	}
+}
+
+func TestSftpFilesystemWstat(t *testing.T) {
+	fs, dir := newTestSftpFilesystem(t)
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := Stat{Mode: ^uint32(0), Length: ^uint64(0)}
+
+	stat := unchanged
+	stat.Length = 2
+	if err := fs.Wstat("/file", stat); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "he" {
+		t.Errorf("got '%s', want '%s'", data, "he")
+	}
+
+	stat = unchanged
+	stat.Mode = 0600
+	stat.Uid = "?"
+	stat.Gid = "?"
+	if err := fs.Wstat("/file", stat); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.Stat("/file"); err != nil || got.Mode != 0600 {
+		t.Errorf("got mode %#o and %v, want %#o", got.Mode, err, 0600)
+	}
+
+	for _, stat := range []Stat{
+		{Mode: ^uint32(0), Length: ^uint64(0), Uid: "glenda"},
+		{Mode: ^uint32(0), Length: ^uint64(0), Gid: "sys"},
+		{Mode: ^uint32(0), Length: ^uint64(0), Name: "renamed"},
+	} {
+		if err := fs.Wstat("/file", stat); err != ErrNotSupported {
+			t.Errorf("%+v: got %v, want %v", stat, err, ErrNotSupported)
+		}
+	}
+}
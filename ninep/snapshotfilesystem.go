@@ -0,0 +1,203 @@
+package ninep
+
+import (
+	p "path"
+	"sync"
+)
+
+// snapshotFilesystem is a read-only view of another filesystem as it was when
+// it was first used, which is when a client attaches to it. Filesystems which
+// are Snapshotters are copied. Of other filesystems only the directory tree
+// and the qids of the files are recorded, and files which changed since are
+// refused with ErrStaleSnapshot instead of serving their new contents.
+type snapshotFilesystem struct {
+	inner Filesystem
+
+	once sync.Once
+	err  error
+	copy Filesystem
+	// stats and children hold the recorded tree when inner could not be
+	// copied, keyed by clean path.
+	stats    map[string]Stat
+	children map[string][]Stat
+}
+
+// snapshotFile is a File of a recorded tree, which checks on every read that
+// the file still has the qid it had when the snapshot was taken.
+type snapshotFile struct {
+	File
+	stat Stat
+}
+
+// NewSnapshotFilesystem returns a read-only filesystem serving inner as it was
+// when a client first attached to it. It is meant to be given to
+// WithSessionFilesystem, so every session gets its own consistent view, for
+// example to back the tree up while it is in use.
+func NewSnapshotFilesystem(inner Filesystem) Filesystem {
+	return &snapshotFilesystem{inner: inner}
+}
+
+func (f *snapshotFilesystem) take() error {
+	f.once.Do(func() {
+		if snapshotter, ok := f.inner.(Snapshotter); ok {
+			f.copy = snapshotter.Snapshot()
+			return
+		}
+		f.stats = make(map[string]Stat)
+		f.children = make(map[string][]Stat)
+		f.err = f.record("/")
+	})
+	return f.err
+}
+
+func (f *snapshotFilesystem) record(path string) error {
+	stat, err := f.inner.Stat(path)
+	if err != nil {
+		return err
+	}
+	f.stats[path] = stat
+	if stat.Mode&DMDIR == 0 {
+		return nil
+	}
+	stats, err := f.inner.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	f.children[path] = stats
+	for _, child := range stats {
+		childPath := p.Join(path, child.Name)
+		if child.Mode&DMDIR == 0 {
+			f.stats[childPath] = child
+			continue
+		}
+		if err := f.record(childPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *snapshotFilesystem) Open(path string, mode uint8) (File, error) {
+	if err := f.take(); err != nil {
+		return nil, err
+	}
+	if mode&3 == OWRITE || mode&3 == ORDWR || mode&(OTRUNC|ORCLOSE) != 0 {
+		return nil, ErrPermissionDenied
+	}
+	if f.copy != nil {
+		return f.copy.Open(path, mode)
+	}
+	path = p.Clean("/" + path)
+	stat, ok := f.stats[path]
+	if !ok {
+		return nil, ErrDoesNotExist
+	}
+	file, err := f.inner.Open(path, mode)
+	if err == ErrDoesNotExist {
+		return nil, ErrStaleSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Directories are listed from the recorded tree, so only the files
+	// themselves have to be unchanged.
+	if stat.Mode&DMDIR == 0 && !stat.Qid.sameVersion(file.Qid()) {
+		file.Close()
+		return nil, ErrStaleSnapshot
+	}
+	return snapshotFile{file, stat}, nil
+}
+
+func (f *snapshotFilesystem) CreateDir(path string, perm uint32) error {
+	return ErrPermissionDenied
+}
+
+func (f *snapshotFilesystem) CreateFile(path string, perm uint32) error {
+	return ErrPermissionDenied
+}
+
+func (f *snapshotFilesystem) ReadDir(path string) ([]Stat, error) {
+	if err := f.take(); err != nil {
+		return nil, err
+	}
+	if f.copy != nil {
+		return f.copy.ReadDir(path)
+	}
+	path = p.Clean("/" + path)
+	if _, ok := f.stats[path]; !ok {
+		return nil, ErrDoesNotExist
+	}
+	stats, ok := f.children[path]
+	if !ok {
+		return nil, ErrNotDirectory
+	}
+	return append([]Stat(nil), stats...), nil
+}
+
+func (f *snapshotFilesystem) Remove(path string) error {
+	return ErrPermissionDenied
+}
+
+func (f *snapshotFilesystem) Stat(path string) (Stat, error) {
+	if err := f.take(); err != nil {
+		return Stat{}, err
+	}
+	if f.copy != nil {
+		return f.copy.Stat(path)
+	}
+	stat, ok := f.stats[p.Clean("/"+path)]
+	if !ok {
+		return Stat{}, ErrDoesNotExist
+	}
+	return stat, nil
+}
+
+func (f *snapshotFilesystem) Wstat(path string, stat Stat) error {
+	return ErrPermissionDenied
+}
+
+func (f *snapshotFilesystem) Readlink(path string) (string, error) {
+	if err := f.take(); err != nil {
+		return "", err
+	}
+	if f.copy != nil {
+		return readlink(f.copy, path)
+	}
+	if _, ok := f.stats[p.Clean("/"+path)]; !ok {
+		return "", ErrDoesNotExist
+	}
+	return readlink(f.inner, path)
+}
+
+func (f snapshotFile) Qid() Qid {
+	return f.stat.Qid
+}
+
+func (f snapshotFile) Stat() (Stat, error) {
+	return f.stat, nil
+}
+
+func (f snapshotFile) Read(offset uint64, count uint32) ([]byte, error) {
+	data, err := f.File.Read(offset, count)
+	if err != nil {
+		return nil, err
+	}
+	// The file may have been changed while it was open.
+	current, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !f.stat.Qid.sameVersion(current.Qid) {
+		return nil, ErrStaleSnapshot
+	}
+	return data, nil
+}
+
+func (f snapshotFile) Write(offset uint64, data []byte) error {
+	return ErrPermissionDenied
+}
+
+// sameVersion reports whether q and other are the same version of one file.
+func (q Qid) sameVersion(other Qid) bool {
+	return q.Path == other.Path && q.Version == other.Version
+}
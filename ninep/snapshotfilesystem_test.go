@@ -0,0 +1,74 @@
+package ninep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSnapshotFilesystem(t *testing.T) {
+	for name, test := range map[string]struct {
+		fs Filesystem
+		// read is what reading the changed file through the snapshot gives.
+		read    string
+		readErr error
+	}{
+		"mem":   {fs: NewMemFilesystem(), read: "old"},
+		"local": {fs: NewLocalFilesystem(t.TempDir()), readErr: rerror(EStaleSnapshotStr)},
+	} {
+		fs := test.fs
+		if err := fs.CreateDir("/dir", 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeMemFile(t, fs, "/dir/file", "old")
+		writeMemFile(t, fs, "/removed", "x")
+
+		c := newTestClient(t, fs, WithSessionFilesystem(NewSnapshotFilesystem))
+		c.attach(0)
+
+		file, err := fs.Open("/dir/file", OWRITE|OTRUNC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Write(0, []byte("new content")); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		writeMemFile(t, fs, "/added", "x")
+		if err := fs.Remove("/removed"); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, stat := range c.readDir(1) {
+			names = append(names, stat.Name)
+		}
+		if got, want := strings.Join(names, " "), ". .. dir removed"; got != want {
+			t.Errorf("%s: got '%s', want '%s'", name, got, want)
+		}
+
+		if err := c.rpc(&Twalk{Tag: 1, Fid: 0, Newfid: 2, Nwname: []string{"dir", "file"}}, &Rwalk{}); err != nil {
+			t.Fatal(err)
+		}
+		var rstat Rstat
+		if err := c.rpc(&Tstat{Tag: 1, Fid: 2}, &rstat); err != nil {
+			t.Fatal(err)
+		}
+		if rstat.Stat.Length != 3 {
+			t.Errorf("%s: got length %d, want 3", name, rstat.Stat.Length)
+		}
+		if err := c.rpc(&Topen{Tag: 1, Fid: 2, Mode: OWRITE}, &Ropen{}); err != rerror(EPermissionDeniedStr) {
+			t.Errorf("%s: got %v, want %v", name, err, rerror(EPermissionDeniedStr))
+		}
+		err = c.rpc(&Topen{Tag: 1, Fid: 2, Mode: OREAD}, &Ropen{})
+		if err == nil {
+			var rread Rread
+			err = c.rpc(&Tread{Tag: 1, Fid: 2, Offset: 0, Count: 100}, &rread)
+			if got := string(rread.Data); err == nil && got != test.read {
+				t.Errorf("%s: got '%s', want '%s'", name, got, test.read)
+			}
+		}
+		if err != test.readErr {
+			t.Errorf("%s: got %v, want %v", name, err, test.readErr)
+		}
+	}
+}
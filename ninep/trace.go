@@ -0,0 +1,63 @@
+package ninep
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Tracer starts a Span for every request handled by a server. It can be
+// implemented with OpenTelemetry or any other tracing library.
+type Tracer interface {
+	Start(name string) Span
+}
+
+// Span covers the handling of a request, from its arrival until its response
+// is sent.
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) RecordError(err error)              {}
+func (noopSpan) End()                               {}
+
+// WithTracer traces every request with t. Spans are named after the message
+// type and carry its tag, fid and the path of the fid.
+func WithTracer(t Tracer) ServerOption {
+	return func(s *Server) {
+		s.tracer = t
+	}
+}
+
+func (s *session) startSpan(msg interface{}) Span {
+	if s.server.tracer == nil {
+		return noopSpan{}
+	}
+	span := s.server.tracer.Start(messageName(msg))
+	span.SetAttribute("tag", msg.(message).tag())
+	if fid, ok := messageFid(msg); ok {
+		span.SetAttribute("fid", fid)
+		if f, err := s.getFid(fid); err == nil && f.auth == nil {
+			span.SetAttribute("path", f.path)
+		}
+	}
+	return span
+}
+
+// messageFid returns the fid msg operates on, if it has one.
+func messageFid(msg interface{}) (uint32, bool) {
+	fid := reflect.ValueOf(msg).Elem().FieldByName("Fid")
+	if !fid.IsValid() {
+		return 0, false
+	}
+	return uint32(fid.Uint()), true
+}
+
+// messageName returns the name of the type of msg, e.g. "Tstat".
+func messageName(msg interface{}) string {
+	return strings.SplitN(reflect.TypeOf(msg).String(), ".", 2)[1]
+}
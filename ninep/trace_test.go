@@ -0,0 +1,79 @@
+package ninep
+
+import (
+	"sync"
+	"testing"
+)
+
+type fakeSpan struct {
+	name       string
+	attributes map[string]any
+	errors     []error
+	ended      chan struct{}
+}
+
+type fakeTracer struct {
+	mutex sync.Mutex
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(name string) Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	span := &fakeSpan{name: name, attributes: make(map[string]any), ended: make(chan struct{})}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (s *fakeSpan) SetAttribute(key string, value any) {
+	s.attributes[key] = value
+}
+
+func (s *fakeSpan) RecordError(err error) {
+	s.errors = append(s.errors, err)
+}
+
+func (s *fakeSpan) End() {
+	close(s.ended)
+}
+
+// last waits until the last started span ends and returns it.
+func (t *fakeTracer) last() *fakeSpan {
+	t.mutex.Lock()
+	span := t.spans[len(t.spans)-1]
+	t.mutex.Unlock()
+	<-span.ended
+	return span
+}
+
+func TestTracer(t *testing.T) {
+	fs := NewMemFilesystem()
+	if err := fs.CreateDir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	tracer := &fakeTracer{}
+	c := newTestClient(t, fs, WithTracer(tracer))
+	c.attachTree(3, "dir")
+
+	if err := c.rpc(&Tstat{Tag: 7, Fid: 3}, &Rstat{}); err != nil {
+		t.Fatal(err)
+	}
+	span := tracer.last()
+	if span.name != "Tstat" || len(span.errors) != 0 {
+		t.Errorf("got %+v, want a Tstat span without errors", span)
+	}
+	want := map[string]any{"tag": uint16(7), "fid": uint32(3), "path": "/dir"}
+	for key, value := range want {
+		if span.attributes[key] != value {
+			t.Errorf("got %s %v, want %v", key, span.attributes[key], value)
+		}
+	}
+
+	if err := c.rpc(&Tstat{Tag: 8, Fid: 4}, &Rstat{}); err == nil {
+		t.Fatal("got no error for an unknown fid")
+	}
+	span = tracer.last()
+	if len(span.errors) != 1 || span.errors[0] != ErrInvalidFid {
+		t.Errorf("got %+v, want a span recording %v", span, ErrInvalidFid)
+	}
+}
@@ -0,0 +1,72 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+func min[K uint8 | uint16 | uint32 | uint64 | int8 | int16 | int32 | int64](a K, b K) K {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sliceAt returns at most count bytes of b starting at offset, without
+// overflowing for offsets close to the maximum uint64.
+func sliceAt(b []byte, offset uint64, count uint32) []byte {
+	if offset >= uint64(len(b)) {
+		return nil
+	}
+	end := uint64(len(b))
+	if uint64(count) < end-offset {
+		end = offset + uint64(count)
+	}
+	return b[offset:end]
+}
+
+// dirEntriesAt returns the directory entries of listing starting at offset
+// which fit in count bytes. Entries are never split, as 9P requires.
+func dirEntriesAt(listing []byte, offset uint64, count uint32) []byte {
+	if offset >= uint64(len(listing)) {
+		return nil
+	}
+	start := int(offset)
+	end := start
+	for end+2 <= len(listing) {
+		next := end + 2 + int(binary.LittleEndian.Uint16(listing[end:]))
+		if next > len(listing) || uint64(next-start) > uint64(count) {
+			break
+		}
+		end = next
+	}
+	return listing[start:end]
+}
+
+// isEntryBoundary reports whether offset is where an entry of listing starts
+// or at or past its end.
+func isEntryBoundary(listing []byte, offset uint64) bool {
+	if offset >= uint64(len(listing)) {
+		return true
+	}
+	pos := uint64(0)
+	for pos < offset && pos+2 <= uint64(len(listing)) {
+		pos += 2 + uint64(binary.LittleEndian.Uint16(listing[pos:]))
+	}
+	return pos == offset
+}
+
+// renamePaths moves the entries of m for oldPath and the paths below it to
+// newPath.
+func renamePaths[V any](m map[string]V, oldPath string, newPath string) {
+	moved := make(map[string]V)
+	for path, v := range m {
+		if path == oldPath || strings.HasPrefix(path, oldPath+"/") {
+			moved[newPath+path[len(oldPath):]] = v
+			delete(m, path)
+		}
+	}
+	for path, v := range moved {
+		m[path] = v
+	}
+}
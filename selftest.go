@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"9pserver/ninep"
+)
+
+const selftestFile = "9pserver-selftest"
+const selftestRenamed = "9pserver-selftest-renamed"
+const selftestData = "hello, 9p"
+
+// selftestClient is a minimal 9P client sending one request at a time.
+type selftestClient struct {
+	conn io.ReadWriter
+}
+
+type selftestStep struct {
+	name string
+	run  func(c *selftestClient) error
+}
+
+// selftestSteps are run in order, each relying on the ones before it. Fid 0 is
+// the root and fid 1 the file the test creates.
+var selftestSteps = []selftestStep{
+	{"version", func(c *selftestClient) error {
+		var rversion ninep.Rversion
+		err := c.rpc(&ninep.Tversion{Tag: 0xFFFF, Msize: ninep.MaximumMsgSize, Version: ninep.ProtocolVersion}, &rversion)
+		if err != nil {
+			return err
+		}
+		if rversion.Version != ninep.ProtocolVersion {
+			return fmt.Errorf("got version %s, want %s", rversion.Version, ninep.ProtocolVersion)
+		}
+		return nil
+	}},
+	{"attach", func(c *selftestClient) error {
+		return c.rpc(&ninep.Tattach{Tag: 1, Fid: 0, Afid: ninep.NOFID, Uname: "selftest"}, &ninep.Rattach{})
+	}},
+	{"walk", func(c *selftestClient) error {
+		return c.rpc(&ninep.Twalk{Tag: 1, Fid: 0, Newfid: 1, Nwname: []string{}}, &ninep.Rwalk{})
+	}},
+	{"create", func(c *selftestClient) error {
+		return c.rpc(&ninep.Tcreate{Tag: 1, Fid: 1, Name: selftestFile, Perm: 0644, Mode: ninep.ORDWR}, &ninep.Rcreate{})
+	}},
+	{"write", func(c *selftestClient) error {
+		var rwrite ninep.Rwrite
+		err := c.rpc(&ninep.Twrite{Tag: 1, Fid: 1, Offset: 0, Data: []byte(selftestData)}, &rwrite)
+		if err != nil {
+			return err
+		}
+		if rwrite.Count != uint32(len(selftestData)) {
+			return fmt.Errorf("got count %d, want %d", rwrite.Count, len(selftestData))
+		}
+		return nil
+	}},
+	{"read-back", func(c *selftestClient) error {
+		var rread ninep.Rread
+		err := c.rpc(&ninep.Tread{Tag: 1, Fid: 1, Offset: 0, Count: 1024}, &rread)
+		if err != nil {
+			return err
+		}
+		if string(rread.Data) != selftestData {
+			return fmt.Errorf("got '%s', want '%s'", rread.Data, selftestData)
+		}
+		return nil
+	}},
+	{"stat", func(c *selftestClient) error {
+		var rstat ninep.Rstat
+		err := c.rpc(&ninep.Tstat{Tag: 1, Fid: 1}, &rstat)
+		if err != nil {
+			return err
+		}
+		if rstat.Stat.Name != selftestFile || rstat.Stat.Length != uint64(len(selftestData)) {
+			return fmt.Errorf("got name %s and length %d, want %s and %d", rstat.Stat.Name, rstat.Stat.Length, selftestFile, len(selftestData))
+		}
+		return nil
+	}},
+	{"wstat-rename", func(c *selftestClient) error {
+		stat := dontTouchStat()
+		stat.Name = selftestRenamed
+		err := c.rpc(&ninep.Twstat{Tag: 1, Fid: 1, Stat: stat}, &ninep.Rwstat{})
+		if err != nil {
+			return err
+		}
+		var rstat ninep.Rstat
+		err = c.rpc(&ninep.Tstat{Tag: 1, Fid: 1}, &rstat)
+		if err != nil {
+			return err
+		}
+		if rstat.Stat.Name != selftestRenamed {
+			return fmt.Errorf("got name %s, want %s", rstat.Stat.Name, selftestRenamed)
+		}
+		return nil
+	}},
+	{"remove", func(c *selftestClient) error {
+		return c.rpc(&ninep.Tremove{Tag: 1, Fid: 1}, &ninep.Rremove{})
+	}},
+	{"clunk", func(c *selftestClient) error {
+		return c.rpc(&ninep.Tclunk{Tag: 1, Fid: 0}, &ninep.Rclunk{})
+	}},
+}
+
+// selftest runs selftestSteps over conn, writing the result of each of them to
+// out, and reports whether all of them passed.
+func selftest(conn io.ReadWriter, out io.Writer) bool {
+	c := &selftestClient{conn}
+	passed := true
+	for _, step := range selftestSteps {
+		err := step.run(c)
+		if err != nil {
+			passed = false
+			fmt.Fprintf(out, "FAIL %s: %v\n", step.name, err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS %s\n", step.name)
+	}
+	return passed
+}
+
+func (c *selftestClient) rpc(tmsg any, rmsg any) error {
+	err := ninep.SerializeMessage(c.conn, tmsg)
+	if err != nil {
+		return err
+	}
+	msg, err := ninep.DeserializeMessage(c.conn)
+	if err != nil {
+		return err
+	}
+	if rerror, ok := msg.(*ninep.Rerror); ok {
+		return errors.New(rerror.Ename)
+	}
+	if reflect.TypeOf(msg) != reflect.TypeOf(rmsg) {
+		return fmt.Errorf("got %T, want %T", msg, rmsg)
+	}
+	reflect.ValueOf(rmsg).Elem().Set(reflect.ValueOf(msg).Elem())
+	return nil
+}
+
+// dontTouchStat returns a stat which changes nothing when sent in a Twstat.
+func dontTouchStat() ninep.Stat {
+	return ninep.Stat{
+		Stype:  ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    ninep.Qid{Ftype: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^uint32(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
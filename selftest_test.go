@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"9pserver/ninep"
+)
+
+func TestSelftest(t *testing.T) {
+	fs := ninep.NewMemFilesystem()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		_ = ninep.NewServer(nil, fs, false).ServeConn(serverConn)
+	}()
+	out := new(bytes.Buffer)
+	selftest(clientConn, out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(selftestSteps) {
+		t.Fatalf("got %d results, want %d:\n%s", len(lines), len(selftestSteps), out)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "PASS ") {
+			t.Errorf("got '%s', want step %s to pass", line, selftestSteps[i].name)
+		}
+	}
+	for _, name := range []string{selftestFile, selftestRenamed} {
+		if _, err := fs.Stat("/" + name); err != ninep.ErrDoesNotExist {
+			t.Errorf("%s: got %v, want %v", name, err, ninep.ErrDoesNotExist)
+		}
+	}
+}